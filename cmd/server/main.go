@@ -2,20 +2,62 @@ package main
 
 import (
 	"bytes"
+	"cmp"
+	"compress/gzip"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	_ "embed"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
+	"math"
 	"math/rand/v2"
+	"net"
 	"net/http"
+	"net/textproto"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/fsnotify/fsnotify"
 	ginzap "github.com/gin-contrib/zap"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/net/http/httpguts"
+	"golang.org/x/time/rate"
 )
 
+// dashboardHTML is the self-contained web dashboard served at / on the
+// configuration port.
+//
+//go:embed dashboard.html
+var dashboardHTML []byte
+
 var Version = "v0.0.0"
 var Service = "bad-proxy"
 
@@ -25,597 +67,6076 @@ var (
 	readTimeout  = getEnv("READ_TIMEOUT", "300")
 	writeTimeout = getEnv("WRITE_TIMEOUT", "600")
 
+	shutdownTimeout = getEnv("SHUTDOWN_TIMEOUT", "30")
+	seed            = getEnv("SEED", "")
+
+	tlsCertFile   = getEnv("TLS_CERT_FILE", "")
+	tlsKeyFile    = getEnv("TLS_KEY_FILE", "")
+	tlsMinVersion = getEnv("TLS_MIN_VERSION", "1.2")
+
 	portCfg         = getEnv("PORT_CFG", "8070")
 	readTimeoutCfg  = getEnv("READ_TIMEOUT_CFG", "30")
 	writeTimeoutCfg = getEnv("WRITE_TIMEOUT_CFG", "60")
+	configToken     = getEnv("CONFIG_TOKEN", "")
+	configFile      = getEnv("CONFIG_FILE", "")
+
+	tlsCertFileCfg   = getEnv("TLS_CERT_FILE_CFG", "")
+	tlsKeyFileCfg    = getEnv("TLS_KEY_FILE_CFG", "")
+	tlsMinVersionCfg = getEnv("TLS_MIN_VERSION_CFG", "1.2")
 
-	backendURL = getEnv("BACKEND_URL", "http://localhost:8000")
+	backendURL  = getEnv("BACKEND_URL", "http://localhost:8000")
+	backendURLs = getEnv("BACKEND_URLS", "")
+
+	healthCheckPath     = getEnv("HEALTH_CHECK_PATH", "")
+	healthCheckInterval = getEnv("HEALTH_CHECK_INTERVAL", "10")
+
+	maxIdleConns         = getEnv("MAX_IDLE_CONNS", "100")
+	maxIdleConnsPerHost  = getEnv("MAX_IDLE_CONNS_PER_HOST", "100")
+	idleConnTimeout      = getEnv("IDLE_CONN_TIMEOUT", "90")
+	backendTimeout       = getEnv("BACKEND_TIMEOUT", "0")
+	backendTimeoutStatus = getEnv("BACKEND_TIMEOUT_STATUS", "504")
+	protocol             = getEnv("PROTOCOL", protocolHTTP1)
+	mode                 = getEnv("MODE", modeProxy)
+	faultLogOutput       = getEnv("FAULT_LOG_OUTPUT", "")
+	faultLogSample       = getEnv("FAULT_LOG_SAMPLE", "1")
+	logLevel             = getEnv("LOG_LEVEL", "info")
+	logFormat            = getEnv("LOG_FORMAT", "json")
+	webhookURL           = getEnv("WEBHOOK_URL", "")
+	requestIDHeader      = getEnv("REQUEST_ID_HEADER", "X-Request-Id")
+	shadowBackendURL     = getEnv("SHADOW_BACKEND_URL", "")
+	statsFile            = getEnv("STATS_FILE", "")
+	statsFlushInterval   = getEnv("STATS_FLUSH_INTERVAL", "30")
 )
 
-type ProxyConfig struct {
-	Latency        int     `json:"latency"`
-	ConnectLatency int     `json:"connect_latency"`
-	NoBackend      float64 `json:"no_backend"`
-	Error500       float64 `json:"500"`
-	Error400       float64 `json:"400"`
-	Disconnect     float64 `json:"disconnect"`
-	Corrupt        float64 `json:"corrupt"`
-	WindowSize     int     `json:"error_window_size"`
-	ForceErrors    bool    `json:"force_errors"`
+// lockedSource makes a rand.Source safe for concurrent use.
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source
 }
 
-type ErrorStats struct {
-	Total           int                `json:"total_requests"`
-	SuccessCount    int                `json:"success_count"`
-	NoBackendCount  int                `json:"no_backend_count"`
-	Error500Count   int                `json:"error_500_count"`
-	Error400Count   int                `json:"error_400_count"`
-	DisconnectCount int                `json:"disconnect_count"`
-	CorruptCount    int                `json:"corrupt_count"`
-	CurrentRates    map[string]float64 `json:"current_rates"`
-	RecentErrors    []string           `json:"recent_errors"`
-	RecentTotal     int                `json:"recent_total"`
+func (ls *lockedSource) Uint64() uint64 {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	return ls.src.Uint64()
 }
 
+// runtimeSource draws from the goroutine-safe top-level generator.
+type runtimeSource struct{}
+
+func (runtimeSource) Uint64() uint64 {
+	return rand.Uint64()
+}
+
+// rng is used for every random decision. main replaces it with a generator
+// seeded from SEED so that runs with the same config are reproducible.
+var rng = rand.New(runtimeSource{})
+
+const (
+	protocolHTTP1 = "http1"
+	protocolH2C   = "h2c"
+)
+
+const (
+	modeProxy = "proxy"
+	modeMock  = "mock"
+)
+
+// proxyClient is shared by all proxied requests so backend connections are
+// pooled. It is initialized in main from the transport environment variables.
+var proxyClient *http.Client
+
+// backendDeadline bounds the backend exchange of every proxied request,
+// response body included, when it is positive. Requests that run out of time
+// are answered with backendTimeoutCode. Both are set in main from
+// BACKEND_TIMEOUT and BACKEND_TIMEOUT_STATUS.
 var (
-	config = ProxyConfig{
-		Latency:        0,
-		ConnectLatency: 0,
-		NoBackend:      0,
-		Error500:       0,
-		Error400:       0,
-		Disconnect:     0,
-		Corrupt:        0,
-		WindowSize:     100,
-		ForceErrors:    true,
+	backendDeadline    time.Duration
+	backendTimeoutCode = http.StatusGatewayTimeout
+)
+
+// mockEcho is the response body returned for every request in mock mode.
+type mockEcho struct {
+	Method  string      `json:"method"`
+	Path    string      `json:"path"`
+	Query   string      `json:"query,omitempty"`
+	Headers http.Header `json:"headers"`
+	Body    string      `json:"body"`
+}
+
+// mockTransport answers every request with a JSON echo of the request
+// instead of contacting a backend. It replaces the proxy transport when
+// MODE=mock so the response passes through the same faults as a real one.
+type mockTransport struct{}
+
+func (mockTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		_ = req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
 	}
-	configMutex sync.RWMutex
 
-	stats = ErrorStats{
-		RecentErrors: make([]string, 100),
-		CurrentRates: make(map[string]float64),
+	payload, err := json.Marshal(mockEcho{
+		Method:  req.Method,
+		Path:    req.URL.Path,
+		Query:   req.URL.RawQuery,
+		Headers: req.Header,
+		Body:    string(body),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	header := make(http.Header)
+	header.Set("Content-Type", "application/json; charset=utf-8")
+	header.Set("Content-Length", strconv.Itoa(len(payload)))
+
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(payload)),
+		ContentLength: int64(len(payload)),
+		Request:       req,
+	}, nil
+}
+
+var (
+	// backends lists the backend URLs proxied requests are distributed
+	// across. It is parsed in main from BACKEND_URLS, falling back to
+	// BACKEND_URL.
+	backends       []string
+	backendCounter atomic.Uint64
+)
+
+// BackendHealth is the last health check result of a backend.
+type BackendHealth struct {
+	URL       string    `json:"url"`
+	Healthy   bool      `json:"healthy"`
+	LastCheck time.Time `json:"last_check"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+var (
+	backendHealth      = map[string]*BackendHealth{}
+	backendHealthMutex sync.RWMutex
+)
+
+// nextBackend returns the backend for the next request in round-robin order,
+// skipping backends marked down. When every backend is down the round-robin
+// choice is returned anyway.
+func nextBackend() string {
+	n := backendCounter.Add(1) - 1
+
+	backendHealthMutex.RLock()
+	defer backendHealthMutex.RUnlock()
+
+	for i := range uint64(len(backends)) {
+		candidate := backends[(n+i)%uint64(len(backends))]
+		if health, ok := backendHealth[candidate]; !ok || health.Healthy {
+			return candidate
+		}
+	}
+
+	return backends[n%uint64(len(backends))]
+}
+
+// healthCheckTargets returns the backends followed by the distinct backend
+// route URLs of the current configuration.
+func healthCheckTargets() []string {
+	targets := slices.Clone(backends)
+
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+
+	for _, route := range config.BackendRoutes {
+		if !slices.Contains(targets, route.URL) {
+			targets = append(targets, route.URL)
+		}
+	}
+
+	return targets
+}
+
+// runHealthChecks periodically GETs healthPath on every backend and backend
+// route URL and marks it healthy for 2xx and 3xx responses. Route URLs that
+// are no longer configured are dropped from the health table.
+func runHealthChecks(logger *zap.Logger, healthPath string, interval time.Duration) {
+	client := &http.Client{Timeout: interval}
+
+	for {
+		targets := healthCheckTargets()
+		for _, backend := range targets {
+			checkErr := ""
+			resp, err := client.Get(backend + healthPath)
+			if err != nil {
+				checkErr = err.Error()
+			} else {
+				_ = resp.Body.Close()
+				if resp.StatusCode >= http.StatusBadRequest {
+					checkErr = "unhealthy status " + strconv.Itoa(resp.StatusCode)
+				}
+			}
+
+			backendHealthMutex.Lock()
+			health, ok := backendHealth[backend]
+			if !ok {
+				health = &BackendHealth{URL: backend, Healthy: true}
+				backendHealth[backend] = health
+			}
+			if health.Healthy != (checkErr == "") {
+				logger.Warn("Backend health changed",
+					zap.String("backend_url", backend),
+					zap.Bool("healthy", checkErr == ""),
+					zap.String("error", checkErr))
+			}
+			health.Healthy = checkErr == ""
+			health.LastCheck = time.Now()
+			health.LastError = checkErr
+			backendHealthMutex.Unlock()
+		}
+
+		backendHealthMutex.Lock()
+		maps.DeleteFunc(backendHealth, func(backend string, _ *BackendHealth) bool {
+			return !slices.Contains(targets, backend)
+		})
+		backendHealthMutex.Unlock()
+
+		time.Sleep(interval)
+	}
+}
+
+// webhookBufferSize is the number of fault events queued for the webhook
+// before new events are dropped.
+const webhookBufferSize = 1000
+
+// faultEvent is POSTed to WEBHOOK_URL for every request that got a fault.
+type faultEvent struct {
+	Timestamp  time.Time `json:"timestamp"`
+	Path       string    `json:"path"`
+	FaultType  string    `json:"fault_type"`
+	RequestNum int       `json:"request_num"`
+	RequestID  string    `json:"request_id"`
+}
+
+var (
+	// webhookEvents queues events for runWebhook. It stays nil without
+	// WEBHOOK_URL, which turns sendFaultEvent into a no-op.
+	webhookEvents chan faultEvent
+
+	webhookDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "bad_proxy_webhook_dropped_events_total",
+		Help: "Fault events not sent to the webhook because its queue was full.",
+	})
+)
+
+// sendFaultEvent queues event for the webhook without ever blocking the
+// request, the event is dropped when the queue is full.
+func sendFaultEvent(event faultEvent) {
+	if webhookEvents == nil {
+		return
+	}
+
+	select {
+	case webhookEvents <- event:
+	default:
+		webhookDropped.Inc()
+	}
+}
+
+// runWebhook POSTs every queued event as JSON to target, one at a time.
+// Failed deliveries are logged and not retried.
+func runWebhook(logger *zap.Logger, target string, events <-chan faultEvent) {
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	for event := range events {
+		payload, err := json.Marshal(event)
+		if err != nil {
+			logger.Error("Failed to encode fault event", zap.Error(err))
+			continue
+		}
+
+		resp, err := client.Post(target, "application/json", bytes.NewReader(payload))
+		if err != nil {
+			logger.Warn("Failed to send fault event to webhook", zap.Error(err))
+			continue
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode >= http.StatusBadRequest {
+			logger.Warn("Webhook rejected fault event", zap.Int("status", resp.StatusCode))
+		}
+	}
+}
+
+const (
+	// shadowBufferSize is the number of requests queued for the shadow
+	// backend before new ones are dropped, shadowWorkers the number of
+	// requests replayed at once.
+	shadowBufferSize = 1000
+	shadowWorkers    = 4
+
+	// shadowBodyLimit is the largest request body mirrored to the shadow
+	// backend, requests with larger bodies are not mirrored.
+	shadowBodyLimit = 10 << 20
+)
+
+// shadowRequest is a proxied request replayed to SHADOW_BACKEND_URL.
+type shadowRequest struct {
+	method        string
+	url           string
+	header        http.Header
+	body          []byte
+	path          string
+	requestID     string
+	primaryStatus int
+}
+
+var (
+	// shadowRequests queues requests for runShadow. It stays nil without
+	// SHADOW_BACKEND_URL, which turns sendShadowRequest into a no-op.
+	shadowRequests chan shadowRequest
+
+	shadowDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "bad_proxy_shadow_dropped_requests_total",
+		Help: "Requests not mirrored to the shadow backend because its queue was full.",
+	})
+)
+
+// sendShadowRequest queues r for the shadow backend without ever blocking
+// the request, r is dropped when the queue is full.
+func sendShadowRequest(r shadowRequest) {
+	if shadowRequests == nil {
+		return
+	}
+
+	select {
+	case shadowRequests <- r:
+	default:
+		shadowDropped.Inc()
+	}
+}
+
+// runShadow replays every queued request with client and discards the
+// response. Status codes that differ from the primary backend's are logged.
+func runShadow(logger *zap.Logger, client *http.Client, requests <-chan shadowRequest) {
+	for r := range requests {
+		req, err := http.NewRequest(r.method, r.url, bytes.NewReader(r.body))
+		if err != nil {
+			logger.Error("Failed to create shadow request", zap.String("request_id", r.requestID), zap.Error(err))
+			continue
+		}
+		req.Header = r.header
+
+		resp, err := client.Do(req)
+		if err != nil {
+			logger.Warn("Shadow request failed",
+				zap.String("request_id", r.requestID),
+				zap.String("path", r.path),
+				zap.Error(err))
+			continue
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+
+		if resp.StatusCode != r.primaryStatus {
+			logger.Info("Shadow backend status differs",
+				zap.String("request_id", r.requestID),
+				zap.String("method", r.method),
+				zap.String("path", r.path),
+				zap.Int("primary_status", r.primaryStatus),
+				zap.Int("shadow_status", resp.StatusCode))
+		}
+	}
+}
+
+// shadowBuffer keeps a copy of the request body for the shadow backend as
+// the primary backend request reads it. The transport may still be reading
+// when the response is done, hence the mutex.
+type shadowBuffer struct {
+	mu        sync.Mutex
+	data      []byte
+	expected  int64
+	eof       bool
+	truncated bool
+}
+
+// contents returns the body and whether it was read completely.
+func (sb *shadowBuffer) contents() ([]byte, bool) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	complete := sb.eof || (sb.expected >= 0 && int64(len(sb.data)) == sb.expected)
+	return sb.data, complete && !sb.truncated
+}
+
+// shadowReader copies the request body into buf as it is read.
+type shadowReader struct {
+	io.ReadCloser
+	buf *shadowBuffer
+}
+
+func (sr shadowReader) Read(p []byte) (int, error) {
+	n, err := sr.ReadCloser.Read(p)
+
+	sr.buf.mu.Lock()
+	if len(sr.buf.data)+n > shadowBodyLimit {
+		sr.buf.truncated = true
+	} else {
+		sr.buf.data = append(sr.buf.data, p[:n]...)
+	}
+	if errors.Is(err, io.EOF) {
+		sr.buf.eof = true
+	}
+	sr.buf.mu.Unlock()
+
+	return n, err
+}
+
+const (
+	// maxEventSubscribers bounds the number of concurrent /events streams,
+	// and eventSubscriberBuffer the events queued for a slow subscriber
+	// before new ones are dropped for it.
+	maxEventSubscribers   = 16
+	eventSubscriberBuffer = 100
+)
+
+// eventHub fans fault decisions out to the /events subscribers.
+type eventHub struct {
+	mu          sync.Mutex
+	subscribers map[chan faultEvent]struct{}
+	closed      bool
+}
+
+var faultEventHub = &eventHub{subscribers: map[chan faultEvent]struct{}{}}
+
+// subscribe registers a new subscriber and returns its channel, which is
+// closed by unsubscribe or when the hub is closed. It fails when
+// maxEventSubscribers are already connected.
+func (h *eventHub) subscribe() (chan faultEvent, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed || len(h.subscribers) >= maxEventSubscribers {
+		return nil, false
+	}
+
+	events := make(chan faultEvent, eventSubscriberBuffer)
+	h.subscribers[events] = struct{}{}
+
+	return events, true
+}
+
+func (h *eventHub) unsubscribe(events chan faultEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.subscribers[events]; ok {
+		delete(h.subscribers, events)
+		close(events)
+	}
+}
+
+// publish sends event to every subscriber without blocking, subscribers
+// with a full queue miss it.
+func (h *eventHub) publish(event faultEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for events := range h.subscribers {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+// close ends every stream, so that shutting down the configuration server
+// does not wait for them.
+func (h *eventHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for events := range h.subscribers {
+		delete(h.subscribers, events)
+		close(events)
+	}
+}
+
+// backendsReady reports whether at least one backend passed its latest
+// health check. Without health checks every backend counts as ready. A
+// backend missing from the health table counts as not checked yet.
+func backendsReady() bool {
+	checked := healthCheckPath != "" && mode == modeProxy
+
+	backendHealthMutex.RLock()
+	defer backendHealthMutex.RUnlock()
+
+	for _, backend := range backends {
+		health, ok := backendHealth[backend]
+		if !ok {
+			if !checked {
+				return true
+			}
+			continue
+		}
+		if health.Healthy && (!checked || !health.LastCheck.IsZero()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Capture is a recorded request and the response the client received.
+type Capture struct {
+	Time                  time.Time   `json:"time"`
+	RequestNum            int         `json:"request_num"`
+	Method                string      `json:"method"`
+	Path                  string      `json:"path"`
+	Query                 string      `json:"query,omitempty"`
+	FaultType             string      `json:"fault_type"`
+	Status                int         `json:"status"`
+	DurationMs            int64       `json:"duration_ms"`
+	RequestHeaders        http.Header `json:"request_headers"`
+	RequestBody           string      `json:"request_body"`
+	RequestBodyTruncated  bool        `json:"request_body_truncated"`
+	ResponseHeaders       http.Header `json:"response_headers"`
+	ResponseBody          string      `json:"response_body"`
+	ResponseBodyTruncated bool        `json:"response_body_truncated"`
+}
+
+// captureBuffer keeps the first limit bytes written to it.
+type captureBuffer struct {
+	data      []byte
+	limit     int
+	truncated bool
+}
+
+func (cb *captureBuffer) keep(p []byte) {
+	room := cb.limit - len(cb.data)
+	if len(p) > room {
+		p = p[:max(0, room)]
+		cb.truncated = true
+	}
+	cb.data = append(cb.data, p...)
+}
+
+// captureReader records the start of the request body as the backend
+// request reads it.
+type captureReader struct {
+	io.ReadCloser
+	buf *captureBuffer
+}
+
+func (cr captureReader) Read(p []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(p)
+	cr.buf.keep(p[:n])
+	return n, err
+}
+
+// captureWriter records the start of the response body sent to the client.
+type captureWriter struct {
+	gin.ResponseWriter
+	buf *captureBuffer
+}
+
+func (cw captureWriter) Write(p []byte) (int, error) {
+	cw.buf.keep(p)
+	return cw.ResponseWriter.Write(p)
+}
+
+func (cw captureWriter) WriteString(s string) (int, error) {
+	cw.buf.keep([]byte(s))
+	return cw.ResponseWriter.WriteString(s)
+}
+
+// captureRing holds the most recent captures. entries is used as a ring
+// once it holds limit entries, next is the slot of the oldest one.
+type captureRing struct {
+	mu      sync.Mutex
+	entries []Capture
+	next    int
+}
+
+var captures captureRing
+
+// add stores capture, dropping the oldest entries beyond limit.
+func (cr *captureRing) add(capture Capture, limit int) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	if cr.next != 0 && len(cr.entries) != limit {
+		// the limit changed after the ring wrapped, restore the order
+		cr.entries = cr.chronological()
+		cr.next = 0
+	}
+	if len(cr.entries) > limit {
+		cr.entries = slices.Clone(cr.entries[len(cr.entries)-limit:])
+	}
+
+	if len(cr.entries) < limit {
+		cr.entries = append(cr.entries, capture)
+		return
+	}
+	cr.entries[cr.next] = capture
+	cr.next = (cr.next + 1) % limit
+}
+
+// list returns a copy of the captures from oldest to newest.
+func (cr *captureRing) list() []Capture {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	return cr.chronological()
+}
+
+func (cr *captureRing) clear() {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	cr.entries = nil
+	cr.next = 0
+}
+
+// chronological must be called with mu held.
+func (cr *captureRing) chronological() []Capture {
+	ordered := make([]Capture, 0, len(cr.entries))
+	ordered = append(ordered, cr.entries[cr.next:]...)
+	return append(ordered, cr.entries[:cr.next]...)
+}
+
+// FaultConfig holds the latency and error probabilities applied to a
+// request. It is embedded in ProxyConfig for the global defaults and in
+// RouteConfig for per-path overrides.
+type FaultConfig struct {
+	Latency          int     `json:"latency" jsonschema:"minimum=0"`
+	ConnectLatency   int     `json:"connect_latency" jsonschema:"minimum=0"`
+	LatencyMs        int     `json:"latency_ms" jsonschema:"minimum=0"`
+	ConnectLatencyMs int     `json:"connect_latency_ms" jsonschema:"minimum=0"`
+	LatencyMinMs     int     `json:"latency_min_ms" jsonschema:"minimum=0"`
+	LatencyMaxMs     int     `json:"latency_max_ms" jsonschema:"minimum=0"`
+	NoBackend        float64 `json:"no_backend" jsonschema:"minimum=0,maximum=1"`
+	Error500         float64 `json:"500" jsonschema:"minimum=0,maximum=1"`
+	Error400         float64 `json:"400" jsonschema:"minimum=0,maximum=1"`
+	Disconnect       float64 `json:"disconnect" jsonschema:"minimum=0,maximum=1"`
+	Corrupt          float64 `json:"corrupt" jsonschema:"minimum=0,maximum=1"`
+
+	// ErrorLatencyMs replaces the latency of injected status errors and
+	// no_backend responses when set, so that failures can be faster or
+	// slower than successful requests. Zero makes them immediate.
+	ErrorLatencyMs *int `json:"error_latency_ms" jsonschema:"minimum=0"`
+
+	// LatencyDistribution selects how the latency of a request is sampled:
+	// "fixed" (Latency plus LatencyMs), "uniform" (LatencyMinMs to
+	// LatencyMaxMs), "normal" (LatencyMeanMs and LatencyStddevMs) or
+	// "exponential" (LatencyMeanMs). When empty it is uniform if
+	// LatencyMaxMs is set and fixed otherwise.
+	LatencyDistribution string  `json:"latency_distribution" jsonschema:"enum=,enum=fixed,enum=uniform,enum=normal,enum=exponential"`
+	LatencyMeanMs       float64 `json:"latency_mean_ms" jsonschema:"minimum=0"`
+	LatencyStddevMs     float64 `json:"latency_stddev_ms" jsonschema:"minimum=0"`
+
+	// NoBackendStatus and NoBackendBody replace the 200 and the JSON message
+	// answered by the no_backend fault, e.g. to act like a gateway that
+	// returns a 502. The body is sent with ErrorContentType.
+	NoBackendStatus int    `json:"no_backend_status" jsonschema:"minimum=100,maximum=599,zero"`
+	NoBackendBody   string `json:"no_backend_body"`
+
+	// LatencyPerKBMs delays proxied responses by this many milliseconds per
+	// KiB of response body, on top of the fixed latency, to model a
+	// bandwidth-bound backend.
+	LatencyPerKBMs float64 `json:"latency_per_kb_ms" jsonschema:"minimum=0"`
+
+	// HeaderLatencyMs holds back the status line and headers of proxied
+	// responses for this many milliseconds after the backend answered, and
+	// then sends them ahead of the body, to model a slow time to first byte
+	// independently of the body.
+	HeaderLatencyMs int `json:"header_latency_ms" jsonschema:"minimum=0"`
+
+	// Reset is the probability of aborting the connection with a TCP RST
+	// instead of the graceful close used by Disconnect.
+	Reset float64 `json:"reset" jsonschema:"minimum=0,maximum=1"`
+
+	// Tarpit is the probability of accepting the request and never
+	// answering it. The connection is held for up to TarpitMaxMs
+	// milliseconds, or until the client gives up when 0, and then closed.
+	Tarpit      float64 `json:"tarpit" jsonschema:"minimum=0,maximum=1"`
+	TarpitMaxMs int     `json:"tarpit_max_ms" jsonschema:"minimum=0"`
+
+	// UploadDisconnect is the probability of closing the connection after
+	// UploadDisconnectBytes bytes of the request body have been received.
+	UploadDisconnect      float64 `json:"upload_disconnect" jsonschema:"minimum=0,maximum=1"`
+	UploadDisconnectBytes int64   `json:"upload_disconnect_bytes" jsonschema:"minimum=0"`
+
+	// RequestCorrupt is the probability of altering the request body before
+	// it is forwarded to the backend, with RequestCorruptMode: truncate
+	// (default), bitflip or shuffle. The modes take the same CorruptXxx
+	// settings as for response bodies.
+	RequestCorrupt     float64 `json:"request_corrupt" jsonschema:"minimum=0,maximum=1"`
+	RequestCorruptMode string  `json:"request_corrupt_mode" jsonschema:"enum=,enum=truncate,enum=bitflip,enum=shuffle"`
+
+	// StatusErrors maps an HTTP status code to the probability of returning
+	// it. The Error500 and Error400 fields are aliases for the 500 and 400
+	// entries and are used when the map does not contain those codes.
+	StatusErrors map[int]float64 `json:"status_errors" jsonschema:"minimum=0,maximum=1"`
+
+	// Error500Body and Error400Body replace the default JSON body of injected
+	// 500 and 400 errors and are written verbatim with ErrorContentType.
+	Error500Body     string `json:"error_500_body"`
+	Error400Body     string `json:"error_400_body"`
+	ErrorContentType string `json:"error_content_type"`
+
+	// RetryAfter is sent in seconds as the Retry-After header of injected
+	// 503 and 429 errors when positive. RateLimitHeaders adds the
+	// X-RateLimit-Limit, X-RateLimit-Remaining and X-RateLimit-Reset headers
+	// to them, reporting RateLimitLimit (default 100) as the limit.
+	RetryAfter       int  `json:"retry_after" jsonschema:"minimum=0"`
+	RateLimitHeaders bool `json:"rate_limit_headers"`
+	RateLimitLimit   int  `json:"rate_limit_limit" jsonschema:"minimum=0"`
+
+	// CorruptMode selects how a corrupted response body is altered: truncate
+	// (default), bitflip, shuffle, compressed or inflate. CorruptFlipPercent
+	// is the percentage of bytes flipped by bitflip (default 1).
+	CorruptMode        string  `json:"corrupt_mode" jsonschema:"enum=,enum=truncate,enum=bitflip,enum=shuffle,enum=compressed,enum=inflate"`
+	CorruptFlipPercent float64 `json:"corrupt_flip_percent" jsonschema:"minimum=0,maximum=100"`
+
+	// CorruptInflateBytes is the number of random bytes inflate appends to
+	// the body (default 64).
+	CorruptInflateBytes int `json:"corrupt_inflate_bytes" jsonschema:"minimum=0"`
+
+	// CorruptMinFraction and CorruptMaxFraction bound the share of the body
+	// kept by truncate (default 0.1 and 0.9).
+	CorruptMinFraction float64 `json:"corrupt_min_fraction" jsonschema:"minimum=0,maximum=1"`
+	CorruptMaxFraction float64 `json:"corrupt_max_fraction" jsonschema:"minimum=0,maximum=1"`
+
+	// CorruptMaxBytes caps the length kept by truncate when positive. The
+	// fractions pick the length first and the cap applies on top, so large
+	// bodies are always cut at CorruptMaxBytes.
+	CorruptMaxBytes int `json:"corrupt_max_bytes" jsonschema:"minimum=0"`
+
+	// CorruptFixContentLength rewrites the backend Content-Length to the
+	// length of the corrupted body. By default the original length is kept
+	// so clients see the mismatch.
+	CorruptFixContentLength bool `json:"corrupt_fix_content_length"`
+
+	// CorruptOnlyStatus limits the corrupt fault to backend responses with
+	// one of these status codes, others are proxied intact. Empty corrupts
+	// every response.
+	CorruptOnlyStatus []int `json:"corrupt_only_status"`
+
+	// HeaderCorrupt is the probability of mangling the response headers with
+	// the HeaderCorruptActions (all actions when empty).
+	HeaderCorrupt        float64  `json:"header_corrupt" jsonschema:"minimum=0,maximum=1"`
+	HeaderCorruptActions []string `json:"header_corrupt_actions" jsonschema:"enum=drop-content-length,enum=bad-content-type,enum=duplicate-set-cookie"`
+
+	// BadStatusLine is the probability of answering with a raw response
+	// whose status line is malformed in one of the BadStatusLineModes (all
+	// modes when empty).
+	BadStatusLine      float64  `json:"bad_status_line" jsonschema:"minimum=0,maximum=1"`
+	BadStatusLineModes []string `json:"bad_status_line_modes" jsonschema:"enum=http10,enum=no-reason,enum=lowercase"`
+
+	// BadEncoding is the probability of sending the response body with a
+	// Content-Encoding it does not match, in one of the BadEncodingModes
+	// (all modes when empty).
+	BadEncoding      float64  `json:"bad_encoding" jsonschema:"minimum=0,maximum=1"`
+	BadEncodingModes []string `json:"bad_encoding_modes" jsonschema:"enum=fake-gzip,enum=fake-br,enum=double-gzip"`
+
+	// PartialHang is the probability of writing only PartialHangFraction of
+	// the response body (default 0.5) and then holding the connection open
+	// for PartialHangMs milliseconds, or until the client gives up when 0.
+	PartialHang         float64 `json:"partial_hang" jsonschema:"minimum=0,maximum=1"`
+	PartialHangFraction float64 `json:"partial_hang_fraction" jsonschema:"minimum=0,maximum=1"`
+	PartialHangMs       int     `json:"partial_hang_ms" jsonschema:"minimum=0"`
+
+	// DisconnectAfterHeaders makes the disconnect fault proxy the request and
+	// close the connection after the status line, the headers and the first
+	// DisconnectAfterBytes bytes of the body instead of before answering.
+	DisconnectAfterHeaders bool  `json:"disconnect_after_headers"`
+	DisconnectAfterBytes   int64 `json:"disconnect_after_bytes" jsonschema:"minimum=0"`
+
+	// WebSocketDisconnectMaxMs bounds the random time after which a
+	// WebSocket tunnel selected for the disconnect fault is closed
+	// (default 5000).
+	WebSocketDisconnectMaxMs int `json:"websocket_disconnect_max_ms" jsonschema:"minimum=0"`
+
+	// InjectHeaders are set on proxied responses after the backend headers
+	// have been copied. A value of deleteHeader removes the header instead.
+	InjectHeaders map[string]string `json:"inject_headers"`
+
+	// MaxKBps caps the rate at which proxied response bodies are written to
+	// the client, in kilobytes per second. Zero disables the cap.
+	MaxKBps int `json:"max_kbps" jsonschema:"minimum=0"`
+
+	// DripEnabled trickles proxied response bodies to the client at
+	// DripBytesPerSec instead of sending them at once.
+	DripEnabled     bool `json:"drip_enabled"`
+	DripBytesPerSec int  `json:"drip_bytes_per_sec" jsonschema:"minimum=0"`
+}
+
+// deleteHeader is the InjectHeaders value that removes a backend header.
+const deleteHeader = "__delete__"
+
+// statusErrors returns StatusErrors merged with the legacy Error500 and
+// Error400 aliases.
+func (fc FaultConfig) statusErrors() map[int]float64 {
+	merged := make(map[int]float64, len(fc.StatusErrors)+2)
+	if fc.Error500 > 0 {
+		merged[http.StatusInternalServerError] = fc.Error500
+	}
+	if fc.Error400 > 0 {
+		merged[http.StatusBadRequest] = fc.Error400
+	}
+	for code, prob := range fc.StatusErrors {
+		merged[code] = prob
+	}
+
+	return merged
+}
+
+// statusErrorBody returns the configured body for an injected status error
+// and its content type, or an empty body when the default should be used.
+func (fc FaultConfig) statusErrorBody(code int) (string, string) {
+	contentType := fc.ErrorContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+
+	switch code {
+	case http.StatusInternalServerError:
+		return fc.Error500Body, contentType
+	case http.StatusBadRequest:
+		return fc.Error400Body, contentType
+	}
+
+	return "", contentType
+}
+
+// setBackoffHeaders adds the configured Retry-After and X-RateLimit-*
+// headers to an injected status error. Only 503 and 429 carry them.
+func (fc FaultConfig) setBackoffHeaders(h http.Header, code int) {
+	if code != http.StatusServiceUnavailable && code != http.StatusTooManyRequests {
+		return
+	}
+
+	if fc.RetryAfter > 0 {
+		h.Set("Retry-After", strconv.Itoa(fc.RetryAfter))
+	}
+
+	if fc.RateLimitHeaders {
+		limit := fc.RateLimitLimit
+		if limit <= 0 {
+			limit = 100
+		}
+		setRateLimitHeaders(h, limit, fc.RetryAfter)
+	}
+}
+
+// setRateLimitHeaders reports an exhausted rate limit of limit requests that
+// resets in resetSeconds.
+func setRateLimitHeaders(h http.Header, limit, resetSeconds int) {
+	h.Set("X-RateLimit-Limit", strconv.Itoa(limit))
+	h.Set("X-RateLimit-Remaining", "0")
+	h.Set("X-RateLimit-Reset", strconv.Itoa(resetSeconds))
+}
+
+// faultWeight pairs an error type with its configured probability.
+type faultWeight struct {
+	errorType string
+	prob      float64
+}
+
+// faultWeights returns every fault in evaluation order: disconnect, reset,
+// tarpit, upload_disconnect, status errors from the highest code down,
+// no_backend, corrupt, partial_hang, header_corrupt, bad_status_line,
+// request_corrupt and bad_encoding.
+func (fc FaultConfig) faultWeights() []faultWeight {
+	weights := []faultWeight{
+		{"disconnect", fc.Disconnect},
+		{"reset", fc.Reset},
+		{"tarpit", fc.Tarpit},
+		{"upload_disconnect", fc.UploadDisconnect},
+	}
+
+	statusErrors := fc.statusErrors()
+	codes := slices.Sorted(maps.Keys(statusErrors))
+	slices.Reverse(codes)
+	for _, code := range codes {
+		weights = append(weights, faultWeight{statusErrorType(code), statusErrors[code]})
+	}
+
+	return append(weights,
+		faultWeight{"no_backend", fc.NoBackend},
+		faultWeight{"corrupt", fc.Corrupt},
+		faultWeight{"partial_hang", fc.PartialHang},
+		faultWeight{"header_corrupt", fc.HeaderCorrupt},
+		faultWeight{"bad_status_line", fc.BadStatusLine},
+		faultWeight{"request_corrupt", fc.RequestCorrupt},
+		faultWeight{"bad_encoding", fc.BadEncoding},
+	)
+}
+
+// statusErrorType returns the error type name for an injected status code,
+// e.g. "error503".
+func statusErrorType(code int) string {
+	return "error" + strconv.Itoa(code)
+}
+
+// statusErrorCode returns the status code of a status error type.
+func statusErrorCode(errorType string) (int, bool) {
+	codeStr, ok := strings.CutPrefix(errorType, "error")
+	if !ok {
+		return 0, false
+	}
+
+	code, err := strconv.Atoi(codeStr)
+	return code, err == nil
+}
+
+// PathRewrite rewrites the path of requests before they are sent to the
+// backend. By default a path starting with From has that prefix replaced by
+// To, so {"from": "/", "to": "/v2/"} turns /foo into /v2/foo. With Regex set,
+// From is a regular expression and To its replacement, which may refer to
+// capture groups as $1. Paths are matched in their escaped form.
+type PathRewrite struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Regex bool   `json:"regex"`
+
+	// re is compiled from From by prepareConfig.
+	re *regexp.Regexp
+}
+
+// MockResponse is a canned response returned instead of proxying requests
+// whose path matches Path, which is matched like a route path. Status
+// defaults to 200 and ContentType to application/json.
+type MockResponse struct {
+	Path        string `json:"path"`
+	Status      int    `json:"status"`
+	Body        string `json:"body"`
+	ContentType string `json:"content_type"`
+}
+
+// BackendRoute sends the requests with Method whose path starts with
+// PathPrefix to URL instead of the BACKEND_URL backends, e.g. GETs to a read
+// replica. An empty Method or PathPrefix matches every request.
+type BackendRoute struct {
+	Method     string `json:"method"`
+	PathPrefix string `json:"path_prefix"`
+	URL        string `json:"url"`
+}
+
+// routedBackend returns the URL of the first backend route matching method
+// and requestPath, skipping routes whose backend is marked down.
+func routedBackend(routes []BackendRoute, method, requestPath string) (string, bool) {
+	backendHealthMutex.RLock()
+	defer backendHealthMutex.RUnlock()
+
+	for _, route := range routes {
+		if (route.Method == "" || route.Method == method) && strings.HasPrefix(requestPath, route.PathPrefix) {
+			if health, ok := backendHealth[route.URL]; ok && !health.Healthy {
+				continue
+			}
+			return route.URL, true
+		}
+	}
+
+	return "", false
+}
+
+// mockResponseFor returns the first mock response matching requestPath.
+func mockResponseFor(responses []MockResponse, requestPath string) (MockResponse, bool) {
+	for _, response := range responses {
+		if matchPath(response.Path, requestPath) {
+			return response, true
+		}
+	}
+
+	return MockResponse{}, false
+}
+
+// rewritePath applies the first matching rule to the escaped path of in and
+// returns the URL to build the backend request from, which is in itself when
+// no rule matches.
+func rewritePath(rules []PathRewrite, in *url.URL) *url.URL {
+	escaped := in.EscapedPath()
+	for _, rule := range rules {
+		var rewritten string
+		switch {
+		case rule.re != nil:
+			if !rule.re.MatchString(escaped) {
+				continue
+			}
+			rewritten = rule.re.ReplaceAllString(escaped, rule.To)
+		case strings.HasPrefix(escaped, rule.From):
+			rewritten = rule.To + escaped[len(rule.From):]
+		default:
+			continue
+		}
+
+		decoded, err := url.PathUnescape(rewritten)
+		if err != nil {
+			return in
+		}
+
+		out := *in
+		out.Path, out.RawPath = decoded, rewritten
+		return &out
+	}
+
+	return in
+}
+
+// faultOverrideHeader names the request header that forces a fault when
+// AllowHeaderOverride is enabled.
+const faultOverrideHeader = "X-Bad-Proxy-Fault"
+
+// faultOverride is the fault requested with faultOverrideHeader.
+type faultOverride struct {
+	errorType  string
+	latencyMs  int
+	hasLatency bool
+}
+
+// parseFaultOverride parses a comma-separated faultOverrideHeader value such
+// as "error503", "disconnect" or "corrupt,latency=2000". The fault name is
+// any error type of faultWeights, or "none" for a clean pass-through, which
+// is also used when only a latency is given.
+func parseFaultOverride(value string) (faultOverride, error) {
+	var override faultOverride
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+
+		if ms, ok := strings.CutPrefix(part, "latency="); ok {
+			latency, err := strconv.Atoi(ms)
+			if err != nil || latency < 0 {
+				return override, fmt.Errorf("latency %q must be a non-negative integer of milliseconds", ms)
+			}
+			override.latencyMs, override.hasLatency = latency, true
+			continue
+		}
+
+		if override.errorType != "" {
+			return override, errors.New("only one fault can be forced per request")
+		}
+		if part != "none" && !knownErrorType(part) {
+			return override, fmt.Errorf("unknown fault %q", part)
+		}
+		override.errorType = part
+	}
+
+	if override.errorType == "none" {
+		override.errorType = ""
+	}
+	return override, nil
+}
+
+// knownErrorType reports whether errorType can be chosen by faultWeights.
+func knownErrorType(errorType string) bool {
+	if code, ok := statusErrorCode(errorType); ok {
+		return code >= 200 && code <= 599
+	}
+
+	return slices.ContainsFunc(FaultConfig{}.faultWeights(), func(w faultWeight) bool {
+		return w.errorType == errorType
+	})
+}
+
+// RouteConfig applies its own FaultConfig to requests whose path matches
+// Path. Path is treated as a glob (path.Match) when it contains any of the
+// characters "*?[", otherwise as a prefix.
+type RouteConfig struct {
+	Path string `json:"path"`
+	FaultConfig
+}
+
+type ProxyConfig struct {
+	FaultConfig
+	WindowSize     int            `json:"error_window_size"`
+	ForceErrors    bool           `json:"force_errors"`
+	AllowedMethods []string       `json:"allowed_methods"`
+	Routes         []RouteConfig  `json:"routes"`
+	PathRewrites   []PathRewrite  `json:"path_rewrites"`
+	MockResponses  []MockResponse `json:"mock_responses"`
+	BackendRoutes  []BackendRoute `json:"backend_routes"`
+
+	// MethodOverrides replaces the global FaultConfig for requests with the
+	// given HTTP method, e.g. to fail writes more often than reads. Routes
+	// matching the path still take precedence.
+	MethodOverrides map[string]FaultConfig `json:"method_overrides"`
+
+	// WindowMode selects whether the recent errors window holds the last
+	// WindowSize requests ("count", the default) or the requests of the last
+	// WindowSeconds seconds ("time", default 60).
+	WindowMode    string `json:"error_window_mode" jsonschema:"enum=,enum=count,enum=time"`
+	WindowSeconds int    `json:"error_window_seconds" jsonschema:"minimum=0"`
+
+	// ForceMinSuccessive and ForceMaxSuccessive clamp the number of
+	// successes in a row tolerated by ForceErrors, which is ForceScale
+	// divided by the total error probability. Zero values use the defaults
+	// 5, 20 and 5.0.
+	ForceMinSuccessive int     `json:"force_min_successive" jsonschema:"minimum=0"`
+	ForceMaxSuccessive int     `json:"force_max_successive" jsonschema:"minimum=0"`
+	ForceScale         float64 `json:"force_scale" jsonschema:"minimum=0"`
+
+	// ForceJitterPercent varies the tolerated number of successes randomly
+	// by up to this percentage in either direction, so forced errors do not
+	// arrive at a fixed cadence.
+	ForceJitterPercent float64 `json:"force_jitter_percent" jsonschema:"minimum=0,maximum=100"`
+
+	// MaxBodyBytes rejects request bodies larger than this many bytes with a
+	// 413. Zero disables the limit.
+	MaxBodyBytes int64 `json:"max_body_bytes" jsonschema:"minimum=0"`
+
+	// ReadTimeout and WriteTimeout replace READ_TIMEOUT and WRITE_TIMEOUT
+	// for proxied requests, in seconds from when the request is handled.
+	// Zero keeps the timeouts of the server.
+	ReadTimeout  int `json:"read_timeout" jsonschema:"minimum=0"`
+	WriteTimeout int `json:"write_timeout" jsonschema:"minimum=0"`
+
+	// DisableWebSocket rejects WebSocket upgrade requests with a 501 instead
+	// of tunnelling them to the backend.
+	DisableWebSocket bool `json:"disable_websocket"`
+
+	// RateLimitPerMin answers with a 429 once a client IP has made this many
+	// requests within the last minute. Zero disables rate limiting.
+	RateLimitPerMin int `json:"rate_limit_per_min" jsonschema:"minimum=0"`
+
+	// CircuitThreshold opens the circuit breaker after this many consecutive
+	// backend failures (transport errors or 5xx). While open, requests get
+	// a 503 without reaching the backend for CircuitCooldown seconds
+	// (default 30), then a single probe request decides whether the circuit
+	// closes again. Zero disables the breaker.
+	CircuitThreshold int `json:"circuit_threshold" jsonschema:"minimum=0"`
+	CircuitCooldown  int `json:"circuit_cooldown" jsonschema:"minimum=0"`
+
+	// MaxConcurrency caps the number of requests proxied at once, zero
+	// disables the cap. Requests over the cap get a 503 right away, or with
+	// OnSaturated "queue" after waiting up to QueueTimeoutMs (default 1000)
+	// for a free slot.
+	MaxConcurrency int    `json:"max_concurrency" jsonschema:"minimum=0"`
+	OnSaturated    string `json:"on_saturated" jsonschema:"enum=,enum=reject,enum=queue"`
+	QueueTimeoutMs int    `json:"queue_timeout_ms" jsonschema:"minimum=0"`
+
+	// BurstMode clusters errors: once a fault fires, the fault probabilities
+	// of the next BurstLength requests (default 10) are multiplied by
+	// BurstMultiplier (default 5) before returning to the baseline.
+	BurstMode       bool    `json:"burst_mode"`
+	BurstLength     int     `json:"burst_length" jsonschema:"minimum=0"`
+	BurstMultiplier float64 `json:"burst_multiplier" jsonschema:"minimum=0"`
+
+	// DisableForwardedHeaders passes requests through without adding the
+	// X-Forwarded-For, X-Forwarded-Proto and X-Forwarded-Host headers.
+	DisableForwardedHeaders bool `json:"disable_forwarded_headers"`
+
+	// AllowHeaderOverride lets clients force the fault of a single request
+	// with the X-Bad-Proxy-Fault header, bypassing the probabilities.
+	AllowHeaderOverride bool `json:"allow_header_override"`
+
+	// ExposeFaultHeader reports the fault applied to a request, or "none",
+	// in the X-Bad-Proxy-Fault response header.
+	ExposeFaultHeader bool `json:"expose_fault_header"`
+
+	// CaptureEnabled keeps the last CaptureLimit (default 100) requests
+	// with their responses for GET /captures. Bodies are stored up to
+	// CaptureBodyBytes (default 1024) bytes each.
+	CaptureEnabled   bool `json:"capture_enabled"`
+	CaptureLimit     int  `json:"capture_limit" jsonschema:"minimum=0"`
+	CaptureBodyBytes int  `json:"capture_body_bytes" jsonschema:"minimum=0"`
+
+	// GloballyDisabled is a kill switch that proxies every request without
+	// any fault while keeping the configured probabilities.
+	GloballyDisabled bool `json:"globally_disabled"`
+
+	// MatchHeaders limits fault injection to requests carrying every listed
+	// header with the given value. Other requests are proxied without any
+	// fault. Empty applies faults to all requests.
+	MatchHeaders map[string]string `json:"match_headers"`
+
+	// MatchQuery does the same for query parameters: faults only apply to
+	// requests whose query has every listed parameter with the given value.
+	MatchQuery map[string]string `json:"match_query"`
+
+	// profile is the name of the profile the configuration was activated
+	// from, empty when it was set any other way.
+	profile string
+}
+
+const (
+	windowModeCount = "count"
+	windowModeTime  = "time"
+)
+
+// windowDuration returns the trailing duration of the recent errors window,
+// or 0 when the window is count based.
+func (pc ProxyConfig) windowDuration() time.Duration {
+	if pc.WindowMode != windowModeTime {
+		return 0
+	}
+
+	return time.Duration(cmp.Or(pc.WindowSeconds, 60)) * time.Second
+}
+
+// forcePolicy describes when ForceErrors forces an error.
+type forcePolicy struct {
+	enabled       bool
+	minSuccessive int
+	maxSuccessive int
+	scale         float64
+	jitterPercent float64
+}
+
+// forcePolicy returns the ForceErrors tuning with defaults applied.
+func (pc ProxyConfig) forcePolicy() forcePolicy {
+	return forcePolicy{
+		enabled:       pc.ForceErrors,
+		minSuccessive: cmp.Or(pc.ForceMinSuccessive, 5),
+		maxSuccessive: cmp.Or(pc.ForceMaxSuccessive, 20),
+		scale:         cmp.Or(pc.ForceScale, 5.0),
+		jitterPercent: pc.ForceJitterPercent,
+	}
+}
+
+// burstPolicy describes how BurstMode elevates the fault probabilities.
+type burstPolicy struct {
+	enabled    bool
+	length     int
+	multiplier float64
+}
+
+// burstPolicy returns the BurstMode tuning with defaults applied.
+func (pc ProxyConfig) burstPolicy() burstPolicy {
+	return burstPolicy{
+		enabled:    pc.BurstMode,
+		length:     cmp.Or(pc.BurstLength, 10),
+		multiplier: cmp.Or(pc.BurstMultiplier, 5.0),
+	}
+}
+
+// weights returns the fault weights to decide with. During a burst every
+// probability is multiplied, and scaled down together when they would add
+// up to more than 1.
+func (bp burstPolicy) weights(weights []faultWeight, inBurst bool) []faultWeight {
+	if !bp.enabled || !inBurst {
+		return weights
+	}
+
+	scale := bp.multiplier
+	if total := totalProbability(weights) * bp.multiplier; total > 1 {
+		scale /= total
+	}
+
+	elevated := make([]faultWeight, len(weights))
+	for i, w := range weights {
+		elevated[i] = faultWeight{w.errorType, w.prob * scale}
+	}
+
+	return elevated
+}
+
+// recordBurst advances the burst state of st after a request with
+// errorType. A fault outside of a burst starts one; faults within a burst do
+// not extend it.
+func recordBurst(st *ErrorStats, errorType string, bp burstPolicy) {
+	if !bp.enabled {
+		return
+	}
+
+	if st.BurstRemaining > 0 {
+		st.BurstRemaining--
+		return
+	}
+
+	if errorType != "" {
+		st.BurstRemaining = bp.length
+	}
+}
+
+// faultsFor returns the fault configuration of the first route matching
+// requestPath. Without a matching route it returns the override for method,
+// or the global configuration when there is none.
+func (pc ProxyConfig) faultsFor(method, requestPath string) FaultConfig {
+	for _, route := range pc.Routes {
+		if matchPath(route.Path, requestPath) {
+			return route.FaultConfig
+		}
+	}
+
+	if faults, ok := pc.MethodOverrides[method]; ok {
+		return faults
+	}
+
+	return pc.FaultConfig
+}
+
+// matchHeaders reports whether header has each key of match with its value
+// among the values of that header.
+func matchHeaders(header http.Header, match map[string]string) bool {
+	for name, value := range match {
+		if !slices.Contains(header.Values(name), value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchQuery reports whether the raw query has each key of match with its
+// value among the values of that parameter. A parameter without a value,
+// as in "?debug", matches an empty value.
+func matchQuery(rawQuery string, match map[string]string) bool {
+	if len(match) == 0 {
+		return true
+	}
+
+	query, _ := url.ParseQuery(rawQuery)
+	for name, value := range match {
+		if !slices.Contains(query[name], value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func matchPath(pattern, requestPath string) bool {
+	if strings.ContainsAny(pattern, "*?[") {
+		matched, err := path.Match(pattern, requestPath)
+		return err == nil && matched
+	}
+
+	return strings.HasPrefix(requestPath, pattern)
+}
+
+const (
+	latencyFixed       = "fixed"
+	latencyUniform     = "uniform"
+	latencyNormal      = "normal"
+	latencyExponential = "exponential"
+)
+
+// latencyMs returns the response latency in milliseconds for a single
+// request, sampled from LatencyDistribution. The fixed latency adds the
+// seconds based Latency field and the LatencyMs field; samples of the normal
+// distribution below zero are clamped to zero.
+func (fc FaultConfig) latencyMs() int {
+	switch fc.latencyDistribution() {
+	case latencyUniform:
+		return fc.LatencyMinMs + rng.IntN(fc.LatencyMaxMs-fc.LatencyMinMs+1)
+	case latencyNormal:
+		return max(0, int(math.Round(fc.LatencyMeanMs+rng.NormFloat64()*fc.LatencyStddevMs)))
+	case latencyExponential:
+		return int(math.Round(rng.ExpFloat64() * fc.LatencyMeanMs))
+	}
+
+	return fc.Latency*1000 + fc.LatencyMs
+}
+
+// latencyDistribution returns LatencyDistribution with the default applied.
+func (fc FaultConfig) latencyDistribution() string {
+	switch {
+	case fc.LatencyDistribution != "":
+		return fc.LatencyDistribution
+	case fc.LatencyMaxMs > 0:
+		return latencyUniform
+	}
+
+	return latencyFixed
+}
+
+// errorLatencyMs returns the delay of injected errors and no_backend
+// responses in milliseconds, which is latency unless ErrorLatencyMs is set.
+func (fc FaultConfig) errorLatencyMs(latency int) int {
+	if fc.ErrorLatencyMs == nil {
+		return latency
+	}
+
+	return *fc.ErrorLatencyMs
+}
+
+// corruptFractions returns the truncate bounds with defaults applied.
+func (fc FaultConfig) corruptFractions() (float64, float64) {
+	return cmp.Or(fc.CorruptMinFraction, 0.1), cmp.Or(fc.CorruptMaxFraction, 0.9)
+}
+
+// connectLatencyMs returns the total connect latency in milliseconds.
+func (fc FaultConfig) connectLatencyMs() int {
+	return fc.ConnectLatency*1000 + fc.ConnectLatencyMs
+}
+
+type ErrorStats struct {
+	Total                 int         `json:"total_requests"`
+	SuccessCount          int         `json:"success_count"`
+	NoBackendCount        int         `json:"no_backend_count"`
+	Error500Count         int         `json:"error_500_count"`
+	Error400Count         int         `json:"error_400_count"`
+	StatusErrorCounts     map[int]int `json:"status_error_counts"`
+	DisconnectCount       int         `json:"disconnect_count"`
+	ResetCount            int         `json:"reset_count"`
+	TarpitCount           int         `json:"tarpit_count"`
+	UploadDisconnectCount int         `json:"upload_disconnect_count"`
+	CorruptCount          int         `json:"corrupt_count"`
+	HeaderCorruptCount    int         `json:"header_corrupt_count"`
+	RequestCorruptCount   int         `json:"request_corrupt_count"`
+	BadEncodingCount      int         `json:"bad_encoding_count"`
+	RateLimitedCount      int         `json:"rate_limited_count"`
+	CircuitOpenCount      int         `json:"circuit_open_count"`
+	BackendTimeoutCount   int         `json:"backend_timeout_count"`
+
+	// CorruptInflatedBytes is the number of random bytes appended to
+	// response bodies by the inflate corrupt mode, only maintained on the
+	// global stats.
+	CorruptInflatedBytes int `json:"corrupt_inflated_bytes"`
+
+	// ConcurrencyRejectedCount counts requests turned away by
+	// MaxConcurrency. They are not counted in Total.
+	ConcurrencyRejectedCount int `json:"concurrency_rejected_count"`
+
+	// BackendErrorCount and BackendUnreachableCount count real upstream
+	// failures, 5xx responses of the backend and requests that could not
+	// reach it, as opposed to injected errors.
+	BackendErrorCount       int                `json:"backend_error_count"`
+	BackendUnreachableCount int                `json:"backend_unreachable_count"`
+	PartialHangCount        int                `json:"partial_hang_count"`
+	BadStatusLineCount      int                `json:"bad_status_line_count"`
+	CurrentRates            map[string]float64 `json:"current_rates"`
+	RecentErrors            []string           `json:"recent_errors"`
+	RecentTotal             int                `json:"recent_total"`
+
+	// InFlight and MaxInFlight are the number of requests being proxied
+	// and its high-water mark. They are only reported on the global stats.
+	InFlight    int64 `json:"in_flight"`
+	MaxInFlight int64 `json:"max_in_flight"`
+
+	// Concurrency is the number of MaxConcurrency slots in use, only
+	// reported on the global stats.
+	Concurrency int `json:"concurrency"`
+
+	// Circuit is the circuit breaker state, only reported on the global
+	// stats while the breaker is enabled.
+	Circuit *CircuitBreaker `json:"circuit,omitempty"`
+
+	// BurstRemaining is the number of requests left in the current error
+	// burst of BurstMode, BurstActive reports whether it is positive. Both
+	// are only maintained on the global stats.
+	BurstRemaining int  `json:"burst_remaining"`
+	BurstActive    bool `json:"burst_active"`
+
+	// recentHead is the index in the RecentErrors ring buffer that the next
+	// request is written to and recentFilled the number of slots written
+	// since the buffer was allocated. successStreak counts the successes
+	// written since the last error.
+	recentHead    int
+	recentFilled  int
+	successStreak int
+
+	// windowDuration switches RecentErrors from a ring buffer to a queue
+	// of the requests of the trailing duration, with recentTimes holding
+	// the time of each entry.
+	windowDuration time.Duration
+	recentTimes    []time.Time
+}
+
+// newErrorStats returns empty stats whose window holds the last windowSize
+// requests, or the requests of the last windowDuration when it is set.
+func newErrorStats(windowSize int, windowDuration time.Duration) ErrorStats {
+	s := ErrorStats{StatusErrorCounts: make(map[int]int)}
+	s.resizeRecent(windowSize, windowDuration)
+
+	return s
+}
+
+// loadStats restores the counters saved to file by saveStats into the
+// global counters. The recent window and the runtime state, such as the
+// circuit and the in-flight requests, start over. A missing file is not an
+// error.
+func loadStats(file string) error {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var saved ErrorStats
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("invalid stats format: %w", err)
+	}
+
+	configMutex.RLock()
+	windowSize, windowDuration := config.WindowSize, config.windowDuration()
+	configMutex.RUnlock()
+
+	clearStats(windowSize, windowDuration)
+	counters.total.Store(int64(saved.Total))
+	for result, count := range saved.results() {
+		counters.add(result, int64(count))
+	}
+	counters.inflatedBytes.Store(int64(saved.CorruptInflatedBytes))
+
+	return nil
+}
+
+// saveStats writes the global stats to file, replacing the file atomically.
+func saveStats(file string) error {
+	data, err := json.MarshalIndent(statsReport(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, file)
+}
+
+// runStatsPersistence saves the stats to file every interval.
+func runStatsPersistence(logger *zap.Logger, file string, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := saveStats(file); err != nil {
+			logger.Warn("Unable to save statistics", zap.String("stats_file", file), zap.Error(err))
+		}
+	}
+}
+
+const (
+	maxTrackedPaths = 1000
+	otherPathKey    = "_other"
+)
+
+// pathCountersFor returns the per-path counters of requestPath, creating
+// them when needed. Known paths only take the read lock.
+func pathCountersFor(requestPath string) *requestCounters {
+	pathCountersMutex.RLock()
+	pc, ok := pathCounters[requestPath]
+	if !ok && len(pathCounters) >= maxTrackedPaths {
+		pc, ok = pathCounters[otherPathKey]
+	}
+	pathCountersMutex.RUnlock()
+	if ok {
+		return pc
+	}
+
+	pathCountersMutex.Lock()
+	defer pathCountersMutex.Unlock()
+
+	if pc, ok := pathCounters[requestPath]; ok {
+		return pc
+	}
+
+	if len(pathCounters) >= maxTrackedPaths {
+		requestPath = otherPathKey
+		if pc, ok := pathCounters[requestPath]; ok {
+			return pc
+		}
+	}
+
+	pc = &requestCounters{}
+	pathCounters[requestPath] = pc
+	return pc
+}
+
+// recordRecent writes errorType, recorded at now, to the RecentErrors window.
+func (s *ErrorStats) recordRecent(errorType string, now time.Time) {
+	if s.windowDuration > 0 {
+		// entries that left the window are dropped from the front; append
+		// reclaims the space once the backing array is full
+		start := s.windowStart(now)
+		s.RecentErrors = append(s.RecentErrors[start:], errorType)
+		s.recentTimes = append(s.recentTimes[start:], now)
+		s.recentFilled = len(s.RecentErrors)
+	} else {
+		s.RecentErrors[s.recentHead] = errorType
+		s.recentHead = (s.recentHead + 1) % len(s.RecentErrors)
+		s.recentFilled = min(s.recentFilled+1, len(s.RecentErrors))
+	}
+
+	if errorType == "" {
+		s.successStreak++
+	} else {
+		s.successStreak = 0
+	}
+}
+
+// windowStart returns the index of the oldest RecentErrors entry still inside
+// a time based window at now.
+func (s *ErrorStats) windowStart(now time.Time) int {
+	cutoff := now.Add(-s.windowDuration)
+	start, _ := slices.BinarySearchFunc(s.recentTimes, cutoff, func(t, target time.Time) int {
+		if t.After(target) {
+			return 1
+		}
+		return -1
+	})
+
+	return start
+}
+
+// successiveNoErrors returns the number of successes at the end of the
+// RecentErrors window at now.
+func (s *ErrorStats) successiveNoErrors(now time.Time) int {
+	if s.windowDuration > 0 {
+		return min(s.successStreak, len(s.RecentErrors)-s.windowStart(now))
+	}
+
+	return min(s.successStreak, s.recentFilled)
+}
+
+// resizeRecent replaces the RecentErrors window with an empty one of
+// windowSize slots, or with an empty queue covering windowDuration.
+func (s *ErrorStats) resizeRecent(windowSize int, windowDuration time.Duration) {
+	s.windowDuration = windowDuration
+	s.RecentErrors = make([]string, windowSize)
+	s.recentTimes = nil
+	if windowDuration > 0 {
+		s.RecentErrors = []string{}
+	}
+	s.recentHead = 0
+	s.recentFilled = 0
+	s.successStreak = 0
+}
+
+// recentChronological returns the RecentErrors entries inside the window at
+// now, ordered from oldest to newest.
+func (s *ErrorStats) recentChronological(now time.Time) []string {
+	if s.windowDuration > 0 {
+		return slices.Clone(s.RecentErrors[s.windowStart(now):])
+	}
+
+	if len(s.RecentErrors) == 0 {
+		return []string{}
+	}
+
+	start := (s.recentHead - s.recentFilled + len(s.RecentErrors)) % len(s.RecentErrors)
+
+	recent := make([]string, 0, s.recentFilled)
+	for i := range s.recentFilled {
+		recent = append(recent, s.RecentErrors[(start+i)%len(s.RecentErrors)])
+	}
+
+	return recent
+}
+
+// snapshot returns a copy of the stats that is safe to use after statsMutex
+// is released, with RecentErrors in chronological order. The rates over the
+// window are only computed here, not for every request.
+func (s *ErrorStats) snapshot() ErrorStats {
+	snap := *s
+	snap.StatusErrorCounts = maps.Clone(s.StatusErrorCounts)
+	snap.RecentErrors = s.recentChronological(time.Now())
+	snap.recentTimes = nil
+	snap.RecentTotal = len(snap.RecentErrors)
+	snap.CurrentRates = errorRates(snap.RecentErrors)
+	snap.BurstActive = snap.BurstRemaining > 0
+
+	return snap
+}
+
+// requestCounters hold the totals of ErrorStats that every request adds to,
+// as atomics so that counting a request takes no lock. results maps a
+// result name, as reported by ErrorStats.results, to its *atomic.Int64.
+type requestCounters struct {
+	total         atomic.Int64
+	results       sync.Map
+	inflatedBytes atomic.Int64
+}
+
+// resultName returns the result name counting errorType, "success" for a
+// request without a fault.
+func resultName(errorType string) string {
+	return cmp.Or(errorType, "success")
+}
+
+// count adds a request with the outcome errorType and returns its number.
+func (rc *requestCounters) count(errorType string) int {
+	requestNum := rc.total.Add(1)
+	rc.add(resultName(errorType), 1)
+
+	return int(requestNum)
+}
+
+// add adds n to the counter of result.
+func (rc *requestCounters) add(result string, n int64) {
+	counter, ok := rc.results.Load(result)
+	if !ok {
+		counter, _ = rc.results.LoadOrStore(result, new(atomic.Int64))
+	}
+	counter.(*atomic.Int64).Add(n)
+}
+
+// addTo adds the counters to the totals of s. Requests counted while it runs
+// may be missing from some of them.
+func (rc *requestCounters) addTo(s *ErrorStats) {
+	s.Total += int(rc.total.Load())
+	rc.results.Range(func(result, counter any) bool {
+		s.addResult(result.(string), int(counter.(*atomic.Int64).Load()))
+		return true
+	})
+	s.CorruptInflatedBytes += int(rc.inflatedBytes.Load())
+}
+
+// reset zeroes the counters and returns the total they held.
+func (rc *requestCounters) reset() int {
+	rc.results.Clear()
+	rc.inflatedBytes.Store(0)
+
+	return int(rc.total.Swap(0))
+}
+
+// statsReport returns a snapshot of the global stats with the counters
+// filled in.
+func statsReport() ErrorStats {
+	statsMutex.RLock()
+	report := stats.snapshot()
+	statsMutex.RUnlock()
+	counters.addTo(&report)
+
+	return report
+}
+
+// clearStats starts the global stats, counters and per-path counters over
+// with an empty window and returns the number of requests they had counted.
+func clearStats(windowSize int, windowDuration time.Duration) int {
+	statsMutex.Lock()
+	stats = newErrorStats(windowSize, windowDuration)
+	statsMutex.Unlock()
+
+	pathCountersMutex.Lock()
+	clear(pathCounters)
+	pathCountersMutex.Unlock()
+
+	return counters.reset()
+}
+
+var (
+	config = ProxyConfig{
+		FaultConfig: FaultConfig{
+			Latency:          0,
+			ConnectLatency:   0,
+			LatencyMs:        0,
+			ConnectLatencyMs: 0,
+			LatencyMinMs:     0,
+			LatencyMaxMs:     0,
+			NoBackend:        0,
+			Error500:         0,
+			Error400:         0,
+			Disconnect:       0,
+			Corrupt:          0,
+		},
+		WindowSize:  100,
+		ForceErrors: true,
+	}
+	configMutex sync.RWMutex
+
+	// stats holds the recent window and the burst state, guarded by
+	// statsMutex. Its totals stay zero: requests are counted in counters.
+	stats      = newErrorStats(100, 0)
+	statsMutex sync.RWMutex
+	counters   requestCounters
+
+	// inFlight counts requests currently inside proxyRequest and
+	// maxInFlight is the highest value it reached since the last reset.
+	inFlight    atomic.Int64
+	maxInFlight atomic.Int64
+
+	// pathCounters holds per-path counters keyed by request path and is
+	// guarded by pathCountersMutex. Paths beyond maxTrackedPaths are counted
+	// under otherPathKey to bound memory.
+	pathCounters      = map[string]*requestCounters{}
+	pathCountersMutex sync.RWMutex
+
+	appliedLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "bad_proxy_applied_latency_seconds",
+		Help:    "Delay applied to proxied requests by the latency faults.",
+		Buckets: []float64{0, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	})
+)
+
+// latencyBuckets is the number of buckets of latencyHistogram. Bucket i
+// holds durations up to 1ms * 1.25^i, the last bucket also holds anything
+// longer (about 20 minutes).
+const latencyBuckets = 64
+
+// latencyHistogram records request durations in exponentially sized buckets
+// using atomic counters, so recording never takes a lock.
+type latencyHistogram struct {
+	counts [latencyBuckets]atomic.Uint64
+}
+
+// LatencyStats are percentiles of the request handling duration in
+// milliseconds. Percentiles are reported as the upper bound of their bucket.
+type LatencyStats struct {
+	Count      uint64  `json:"count"`
+	LatencyP50 float64 `json:"latency_p50_ms"`
+	LatencyP95 float64 `json:"latency_p95_ms"`
+	LatencyP99 float64 `json:"latency_p99_ms"`
+}
+
+var requestLatency latencyHistogram
+
+func latencyBucketBound(i int) float64 {
+	return math.Pow(1.25, float64(i))
+}
+
+func (h *latencyHistogram) record(d time.Duration) {
+	ms := float64(d) / float64(time.Millisecond)
+
+	bucket := 0
+	if ms > 1 {
+		bucket = min(int(math.Ceil(math.Log(ms)/math.Log(1.25))), latencyBuckets-1)
+	}
+
+	h.counts[bucket].Add(1)
+}
+
+func (h *latencyHistogram) reset() {
+	for i := range h.counts {
+		h.counts[i].Store(0)
+	}
+}
+
+// stats computes the p50, p95 and p99 latencies from a snapshot of the
+// bucket counters.
+func (h *latencyHistogram) stats() LatencyStats {
+	var counts [latencyBuckets]uint64
+	var total uint64
+	for i := range h.counts {
+		counts[i] = h.counts[i].Load()
+		total += counts[i]
+	}
+
+	percentile := func(p float64) float64 {
+		if total == 0 {
+			return 0
+		}
+
+		target := uint64(math.Ceil(p * float64(total)))
+		var cumulative uint64
+		for i, count := range counts {
+			cumulative += count
+			if cumulative >= target {
+				return latencyBucketBound(i)
+			}
+		}
+
+		return latencyBucketBound(latencyBuckets - 1)
+	}
+
+	return LatencyStats{
+		Count:      total,
+		LatencyP50: percentile(0.50),
+		LatencyP95: percentile(0.95),
+		LatencyP99: percentile(0.99),
+	}
+}
+
+// statsCollector exposes the counters held in stats and the configured
+// fault probabilities as Prometheus metrics.
+type statsCollector struct {
+	requests    *prometheus.Desc
+	results     *prometheus.Desc
+	probability *prometheus.Desc
+	inFlight    *prometheus.Desc
+}
+
+func newStatsCollector() *statsCollector {
+	return &statsCollector{
+		requests: prometheus.NewDesc("bad_proxy_requests_total",
+			"Total number of requests handled by the proxy.", nil, nil),
+		results: prometheus.NewDesc("bad_proxy_results_total",
+			"Number of requests by outcome, success or the injected error type.", []string{"result"}, nil),
+		probability: prometheus.NewDesc("bad_proxy_fault_probability",
+			"Currently configured probability of each fault.", []string{"fault"}, nil),
+		inFlight: prometheus.NewDesc("bad_proxy_in_flight_requests",
+			"Number of requests currently being proxied.", nil, nil),
+	}
+}
+
+func (sc *statsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sc.requests
+	ch <- sc.results
+	ch <- sc.probability
+	ch <- sc.inFlight
+}
+
+func (sc *statsCollector) Collect(ch chan<- prometheus.Metric) {
+	report := ErrorStats{StatusErrorCounts: make(map[int]int)}
+	counters.addTo(&report)
+	results := report.results()
+	total := report.Total
+
+	configMutex.RLock()
+	weights := config.faultWeights()
+	configMutex.RUnlock()
+
+	ch <- prometheus.MustNewConstMetric(sc.requests, prometheus.CounterValue, float64(total))
+	ch <- prometheus.MustNewConstMetric(sc.inFlight, prometheus.GaugeValue, float64(inFlight.Load()))
+	for result, count := range results {
+		ch <- prometheus.MustNewConstMetric(sc.results, prometheus.CounterValue, float64(count), result)
+	}
+	for _, w := range weights {
+		ch <- prometheus.MustNewConstMetric(sc.probability, prometheus.GaugeValue, w.prob, w.errorType)
+	}
+}
+
+// sampledCore passes one in every n entries below the warn level to the
+// wrapped core. Warnings and errors are always written.
+type sampledCore struct {
+	zapcore.Core
+	n       uint64
+	counter *atomic.Uint64
+}
+
+func (sc sampledCore) With(fields []zapcore.Field) zapcore.Core {
+	return sampledCore{Core: sc.Core.With(fields), n: sc.n, counter: sc.counter}
+}
+
+func (sc sampledCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if entry.Level < zapcore.WarnLevel && (sc.counter.Add(1)-1)%sc.n != 0 {
+		return checked
+	}
+
+	return sc.Core.Check(entry, checked)
+}
+
+// loggerConfig returns the zap configuration selected by LOG_LEVEL and
+// LOG_FORMAT. Invalid values fall back to the production defaults and are
+// reported in warnings, to be logged once the logger exists.
+func loggerConfig() (zap.Config, []string) {
+	zapCfg := zap.NewProductionConfig()
+	var warnings []string
+
+	level, err := zapcore.ParseLevel(logLevel)
+	if err != nil {
+		warnings = append(warnings, "LOG_LEVEL must be debug, info, warn, error, dpanic, panic or fatal, using info")
+		level = zapcore.InfoLevel
+	}
+	zapCfg.Level = zap.NewAtomicLevelAt(level)
+
+	switch logFormat {
+	case "json":
+	case "console":
+		zapCfg.Encoding = "console"
+		zapCfg.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+		zapCfg.EncoderConfig.EncodeLevel = zapcore.CapitalLevelEncoder
+	default:
+		warnings = append(warnings, "LOG_FORMAT must be json or console, using json")
+	}
+
+	return zapCfg, warnings
+}
+
+func main() {
+	readTimeoutInt, err := strconv.Atoi(readTimeout)
+	if err != nil {
+		fmt.Println("Parsing error, READ_TIMEOUT must be an integer of seconds.")
+		os.Exit(1)
+	}
+
+	writeTimeoutInt, err := strconv.Atoi(writeTimeout)
+	if err != nil {
+		fmt.Println("Parsing error, WRITE_TIMEOUT must be an integer of seconds.")
+		os.Exit(1)
+	}
+
+	readTimeoutCfgInt, err := strconv.Atoi(readTimeoutCfg)
+	if err != nil {
+		fmt.Println("Parsing error, READ_TIMEOUT_CFG must be an integer of seconds.")
+		os.Exit(1)
+	}
+
+	writeTimeoutCfgInt, err := strconv.Atoi(writeTimeoutCfg)
+	if err != nil {
+		fmt.Println("Parsing error, WRITE_TIMEOUT_CFG must be an integer of seconds.")
+		os.Exit(1)
+	}
+
+	shutdownTimeoutInt, err := strconv.Atoi(shutdownTimeout)
+	if err != nil {
+		fmt.Println("Parsing error, SHUTDOWN_TIMEOUT must be an integer of seconds.")
+		os.Exit(1)
+	}
+
+	if seed != "" {
+		seedInt, err := strconv.ParseUint(seed, 10, 64)
+		if err != nil {
+			fmt.Println("Parsing error, SEED must be an unsigned integer.")
+			os.Exit(1)
+		}
+
+		rng = rand.New(&lockedSource{src: rand.NewPCG(seedInt, seedInt)})
+	}
+
+	maxIdleConnsInt, err := strconv.Atoi(maxIdleConns)
+	if err != nil {
+		fmt.Println("Parsing error, MAX_IDLE_CONNS must be an integer.")
+		os.Exit(1)
+	}
+
+	maxIdleConnsPerHostInt, err := strconv.Atoi(maxIdleConnsPerHost)
+	if err != nil {
+		fmt.Println("Parsing error, MAX_IDLE_CONNS_PER_HOST must be an integer.")
+		os.Exit(1)
+	}
+
+	idleConnTimeoutInt, err := strconv.Atoi(idleConnTimeout)
+	if err != nil {
+		fmt.Println("Parsing error, IDLE_CONN_TIMEOUT must be an integer of seconds.")
+		os.Exit(1)
+	}
+
+	backendTimeoutInt, err := strconv.Atoi(backendTimeout)
+	if err != nil || backendTimeoutInt < 0 {
+		fmt.Println("Parsing error, BACKEND_TIMEOUT must be a non-negative integer of seconds.")
+		os.Exit(1)
+	}
+	backendDeadline = time.Duration(backendTimeoutInt) * time.Second
+
+	backendTimeoutCode, err = strconv.Atoi(backendTimeoutStatus)
+	if err != nil || backendTimeoutCode < 100 || backendTimeoutCode > 599 {
+		fmt.Println("Parsing error, BACKEND_TIMEOUT_STATUS must be an HTTP status code.")
+		os.Exit(1)
+	}
+
+	for _, u := range strings.Split(backendURLs, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			backends = append(backends, u)
+		}
+	}
+	if len(backends) == 0 {
+		backends = []string{backendURL}
+	}
+
+	for _, backend := range backends {
+		if u, err := url.Parse(backend); err != nil || u.Scheme == "" || u.Host == "" {
+			fmt.Printf("Parsing error, backend URL %q must be an absolute URL.\n", backend)
+			os.Exit(1)
+		}
+
+		backendHealth[backend] = &BackendHealth{URL: backend, Healthy: true}
+	}
+
+	if webhookURL != "" {
+		if u, err := url.Parse(webhookURL); err != nil || u.Scheme == "" || u.Host == "" {
+			fmt.Println("Parsing error, WEBHOOK_URL must be an absolute URL.")
+			os.Exit(1)
+		}
+	}
+
+	if shadowBackendURL != "" {
+		if u, err := url.Parse(shadowBackendURL); err != nil || u.Scheme == "" || u.Host == "" {
+			fmt.Println("Parsing error, SHADOW_BACKEND_URL must be an absolute URL.")
+			os.Exit(1)
+		}
+	}
+
+	tlsConfig, err := serverTLSConfig(tlsCertFile, tlsKeyFile, tlsMinVersion, "")
+	if err != nil {
+		fmt.Printf("Parsing error, %s.\n", err.Error())
+		os.Exit(1)
+	}
+
+	tlsConfigCfg, err := serverTLSConfig(tlsCertFileCfg, tlsKeyFileCfg, tlsMinVersionCfg, "_CFG")
+	if err != nil {
+		fmt.Printf("Parsing error, %s.\n", err.Error())
+		os.Exit(1)
+	}
+
+	faultLogSampleInt, err := strconv.Atoi(faultLogSample)
+	if err != nil || faultLogSampleInt <= 0 {
+		fmt.Println("Parsing error, FAULT_LOG_SAMPLE must be a positive integer.")
+		os.Exit(1)
+	}
+
+	healthCheckIntervalInt, err := strconv.Atoi(healthCheckInterval)
+	if err != nil || healthCheckIntervalInt <= 0 {
+		fmt.Println("Parsing error, HEALTH_CHECK_INTERVAL must be a positive integer of seconds.")
+		os.Exit(1)
+	}
+
+	statsFlushIntervalInt, err := strconv.Atoi(statsFlushInterval)
+	if err != nil || statsFlushIntervalInt <= 0 {
+		fmt.Println("Parsing error, STATS_FLUSH_INTERVAL must be a positive integer of seconds.")
+		os.Exit(1)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = maxIdleConnsInt
+	transport.MaxIdleConnsPerHost = maxIdleConnsPerHostInt
+	transport.IdleConnTimeout = time.Duration(idleConnTimeoutInt) * time.Second
+
+	var serverProtocols *http.Protocols
+	switch protocol {
+	case protocolHTTP1:
+	case protocolH2C:
+		// dial backends with HTTP/2 prior knowledge and accept both
+		// HTTP/1.1 and h2c clients
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetUnencryptedHTTP2(true)
+
+		serverProtocols = new(http.Protocols)
+		serverProtocols.SetHTTP1(true)
+		serverProtocols.SetHTTP2(true)
+		serverProtocols.SetUnencryptedHTTP2(true)
+	default:
+		fmt.Println("Parsing error, PROTOCOL must be http1 or h2c.")
+		os.Exit(1)
+	}
+
+	proxyClient = &http.Client{Transport: transport}
+
+	switch mode {
+	case modeProxy:
+	case modeMock:
+		proxyClient = &http.Client{Transport: mockTransport{}}
+	default:
+		fmt.Println("Parsing error, MODE must be proxy or mock.")
+		os.Exit(1)
+	}
+
+	zapCfg, logWarnings := loggerConfig()
+	baseLogger, err := zapCfg.Build()
+	if err != nil {
+		fmt.Printf("Can not build logger: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	logger := baseLogger.With(zap.String("app", Service), zap.String("app_version", Version))
+	for _, warning := range logWarnings {
+		logger.Warn("Invalid logger setting", zap.String("warning", warning))
+	}
+
+	// fault decisions go to their own named logger so they can be routed
+	// separately from the request and application logs
+	faultBaseLogger := baseLogger
+	if faultLogOutput != "" {
+		faultZapCfg := zapCfg
+		faultZapCfg.OutputPaths = []string{faultLogOutput}
+		faultBaseLogger, err = faultZapCfg.Build()
+		if err != nil {
+			fmt.Printf("Can not build fault logger: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+	if faultLogSampleInt > 1 {
+		n := uint64(faultLogSampleInt)
+		faultBaseLogger = faultBaseLogger.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+			return sampledCore{Core: core, n: n, counter: new(atomic.Uint64)}
+		}))
+	}
+	faultLogger := faultBaseLogger.Named("fault").With(zap.String("app", Service), zap.String("app_version", Version))
+
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		logger.Fatal("Unable to set up tracing", zap.Error(err))
+	}
+	if tracingEnabled {
+		logger.Info("Exporting traces over OTLP")
+	}
+	logger.Info("Starting Bad Proxy Server",
+		zap.String("port", port),
+		zap.String("ip", ip),
+		zap.Strings("backend_urls", backends),
+		zap.Bool("config_auth", configToken != ""),
+		zap.String("seed", seed),
+		zap.String("protocol", protocol),
+		zap.String("mode", mode),
+		zap.Bool("tls", tlsConfig != nil),
+		zap.Bool("webhook", webhookURL != ""),
+		zap.String("shadow_backend_url", shadowBackendURL),
+	)
+
+	if webhookURL != "" {
+		webhookEvents = make(chan faultEvent, webhookBufferSize)
+		go runWebhook(logger, webhookURL, webhookEvents)
+	}
+
+	if shadowBackendURL != "" {
+		shadowRequests = make(chan shadowRequest, shadowBufferSize)
+		shadowClient := &http.Client{Transport: transport, Timeout: 30 * time.Second}
+		for range shadowWorkers {
+			go runShadow(logger, shadowClient, shadowRequests)
+		}
+	}
+
+	// mock mode never contacts the backends, so there is nothing to check
+	if healthCheckPath != "" && mode == modeProxy {
+		logger.Info("Starting backend health checks",
+			zap.String("path", healthCheckPath),
+			zap.Int("interval_seconds", healthCheckIntervalInt))
+
+		go runHealthChecks(logger, healthCheckPath, time.Duration(healthCheckIntervalInt)*time.Second)
+	}
+
+	if configFile != "" {
+		fileConfig, err := loadConfigFile(configFile)
+		if err != nil {
+			logger.Fatal("Unable to load configuration file", zap.String("config_file", configFile), zap.Error(err))
+		}
+
+		applyConfig(fileConfig, logger, "file")
+		go watchConfigFile(configFile, logger)
+
+		profilesFile = profilesPath(configFile)
+		profiles, err = loadProfiles(profilesFile)
+		if err != nil {
+			logger.Fatal("Unable to load profiles", zap.String("profiles_file", profilesFile), zap.Error(err))
+		}
+	}
+
+	// the stats are restored once the window of the configuration file is
+	// known
+	if statsFile != "" {
+		if err := loadStats(statsFile); err != nil {
+			logger.Fatal("Unable to load statistics", zap.String("stats_file", statsFile), zap.Error(err))
+		}
+
+		restored := int(counters.total.Load())
+
+		logger.Info("Persisting statistics",
+			zap.String("stats_file", statsFile),
+			zap.Int("flush_interval_seconds", statsFlushIntervalInt),
+			zap.Int("restored_requests", restored))
+		go runStatsPersistence(logger, statsFile, time.Duration(statsFlushIntervalInt)*time.Second)
+	}
+
+	r := gin.New()
+	r.Use(ginzap.GinzapWithConfig(logger, &ginzap.Config{
+		TimeFormat:   time.RFC3339,
+		UTC:          true,
+		DefaultLevel: zapcore.InfoLevel,
+		Context: func(c *gin.Context) []zapcore.Field {
+			// proxyRequest sets the header on requests that arrive without one
+			return []zapcore.Field{zap.String("request_id", c.Request.Header.Get(requestIDHeader))}
+		},
+	}))
+
+	r.Any("/*path", func(c *gin.Context) {
+		proxyRequest(c, logger, faultLogger)
+	})
+
+	rCfg := gin.New()
+	rCfg.Use(ginzap.Ginzap(logger, time.RFC3339, true))
+
+	rCfg.GET("/status", func(c *gin.Context) {
+		configMutex.RLock()
+		backendRoutes := config.BackendRoutes
+		configMutex.RUnlock()
+
+		if backendRoutes == nil {
+			backendRoutes = []BackendRoute{}
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":         "ok",
+			"version":        Version,
+			"port":           port,
+			"ip":             ip,
+			"backend_url":    backends[0],
+			"backend_urls":   backends,
+			"backend_routes": backendRoutes,
+			"mode":           mode,
+		})
+	})
+
+	// liveness and readiness probes for orchestrators, /readyz fails until a
+	// backend passed its health check
+	rCfg.GET("/healthz", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	})
+
+	rCfg.GET("/readyz", func(c *gin.Context) {
+		if !backendsReady() {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "error": "No healthy backend"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "ready"})
+	})
+
+	// the dashboard page itself is public, it asks for the token to call the
+	// API
+	rCfg.GET("/", func(c *gin.Context) {
+		c.Data(http.StatusOK, "text/html; charset=utf-8", dashboardHTML)
+	})
+
+	// every route except /status, the probes and the dashboard requires the
+	// bearer token when CONFIG_TOKEN is set
+	cfgAPI := rCfg.Group("/")
+	if configToken != "" {
+		cfgAPI.Use(requireToken(configToken))
+	}
+
+	prometheus.MustRegister(newStatsCollector(), appliedLatency, webhookDropped, shadowDropped)
+	cfgAPI.GET("/metrics", gin.WrapH(promhttp.Handler()))
+
+	cfgAPI.GET("/backends", func(c *gin.Context) {
+		backendHealthMutex.RLock()
+		table := make([]BackendHealth, 0, len(backends))
+		for _, backend := range backends {
+			// a backend missing from the table has not been checked yet
+			health, ok := backendHealth[backend]
+			if !ok {
+				health = &BackendHealth{URL: backend, Healthy: true}
+			}
+			table = append(table, *health)
+		}
+		routeTable := []BackendHealth{}
+		for backend, health := range backendHealth {
+			if !slices.Contains(backends, backend) {
+				routeTable = append(routeTable, *health)
+			}
+		}
+		backendHealthMutex.RUnlock()
+
+		slices.SortFunc(routeTable, func(a, b BackendHealth) int { return strings.Compare(a.URL, b.URL) })
+
+		c.JSON(http.StatusOK, gin.H{
+			"health_checks":  healthCheckPath != "",
+			"backends":       table,
+			"route_backends": routeTable,
+		})
+	})
+
+	cfgAPI.GET("/config", func(c *gin.Context) {
+		configMutex.RLock()
+		currentConfig := config
+		configMutex.RUnlock()
+
+		currentStats := statsReport()
+		currentStats.InFlight = inFlight.Load()
+		currentStats.MaxInFlight = maxInFlight.Load()
+		if currentConfig.MaxConcurrency > 0 {
+			currentStats.Concurrency = concurrencyInUse()
+		}
+		if currentConfig.CircuitThreshold > 0 {
+			breaker := circuitState()
+			currentStats.Circuit = &breaker
+		}
+
+		gzipJSON(c, http.StatusOK, gin.H{
+			"config":         currentConfig,
+			"active_profile": currentConfig.profile,
+			"stats":          currentStats,
+		})
+	})
+
+	cfgAPI.GET("/config/schema", func(c *gin.Context) {
+		c.JSON(http.StatusOK, configSchema())
+	})
+
+	cfgAPI.GET("/stats/by-path", func(c *gin.Context) {
+		pathCountersMutex.RLock()
+		byPath := make(map[string]ErrorStats, len(pathCounters))
+		for requestPath, pc := range pathCounters {
+			ps := newErrorStats(0, 0)
+			pc.addTo(&ps)
+			byPath[requestPath] = ps.snapshot()
+		}
+		pathCountersMutex.RUnlock()
+
+		c.JSON(http.StatusOK, byPath)
+	})
+
+	cfgAPI.GET("/stats/latency", func(c *gin.Context) {
+		c.JSON(http.StatusOK, requestLatency.stats())
+	})
+
+	resetStats := func(c *gin.Context) {
+		configMutex.RLock()
+		windowSize, windowDuration := config.WindowSize, config.windowDuration()
+		configMutex.RUnlock()
+
+		cleared := clearStats(windowSize, windowDuration)
+		resetRateLimits()
+		resetCircuit()
+		requestLatency.reset()
+		maxInFlight.Store(inFlight.Load())
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":           "Statistics reset successful",
+			"cleared_requests": cleared,
+		})
+	}
+
+	cfgAPI.DELETE("/stats", resetStats)
+	cfgAPI.POST("/reset-stats", resetStats)
+
+	// GET is kept for existing scripts, but prefetchers and crawlers can
+	// trigger it by accident
+	cfgAPI.GET("/reset-stats", func(c *gin.Context) {
+		logger.Warn("GET /reset-stats is deprecated, use DELETE /stats or POST /reset-stats")
+		resetStats(c)
+	})
+
+	cfgAPI.POST("/config", func(c *gin.Context) {
+		if err := gunzipRequestBody(c.Request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid gzip body: " + err.Error()})
+			return
+		}
+
+		var newConfig ProxyConfig
+		if err := bindStrictJSON(c, &newConfig); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid configuration format: " + err.Error()})
+			return
+		}
+
+		if err := prepareConfig(&newConfig); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		applyConfig(newConfig, logger, "api")
+
+		c.JSON(http.StatusOK, gin.H{"status": "configuration updated"})
+	})
+
+	cfgAPI.PATCH("/config", func(c *gin.Context) {
+		if err := gunzipRequestBody(c.Request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid gzip body: " + err.Error()})
+			return
+		}
+
+		// the body is read before the configuration is locked so that a slow
+		// client does not hold up the proxied requests
+		if c.Request.Body == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid configuration format: missing request body"})
+			return
+		}
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+			return
+		}
+
+		// the merge runs under the configuration lock so that no other
+		// update lands between reading the current configuration and
+		// replacing it
+		invalidFormat := false
+		newConfig, err := updateConfig(func(current ProxyConfig) (ProxyConfig, error) {
+			merged, err := mergeConfig(current, body)
+			if err != nil {
+				invalidFormat = true
+				return merged, err
+			}
+			return merged, prepareConfig(&merged)
+		}, logger, "patch")
+		if err != nil {
+			message := err.Error()
+			if invalidFormat {
+				message = "Invalid configuration format: " + message
+			}
+			c.JSON(http.StatusBadRequest, gin.H{"error": message})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "configuration updated", "config": newConfig})
+	})
+
+	cfgAPI.GET("/profiles", func(c *gin.Context) {
+		configMutex.RLock()
+		active := config.profile
+		configMutex.RUnlock()
+
+		profilesMutex.Lock()
+		stored := maps.Clone(profiles)
+		profilesMutex.Unlock()
+
+		c.JSON(http.StatusOK, gin.H{
+			"active_profile": active,
+			"profiles":       stored,
+		})
+	})
+
+	cfgAPI.GET("/profiles/:name", func(c *gin.Context) {
+		profilesMutex.Lock()
+		profile, ok := profiles[c.Param("name")]
+		profilesMutex.Unlock()
+
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Unknown profile " + c.Param("name")})
+			return
+		}
+
+		c.JSON(http.StatusOK, profile)
+	})
+
+	cfgAPI.PUT("/profiles/:name", func(c *gin.Context) {
+		if err := gunzipRequestBody(c.Request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid gzip body: " + err.Error()})
+			return
+		}
+
+		var profile ProxyConfig
+		if err := bindStrictJSON(c, &profile); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid configuration format: " + err.Error()})
+			return
+		}
+
+		if err := prepareConfig(&profile); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := storeProfile(c.Param("name"), profile); err != nil {
+			logger.Error("Unable to save profiles", zap.String("profiles_file", profilesFile), zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Profile stored but not saved: " + err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "profile stored"})
+	})
+
+	cfgAPI.DELETE("/profiles/:name", func(c *gin.Context) {
+		found, err := deleteProfile(c.Param("name"))
+		if !found {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Unknown profile " + c.Param("name")})
+			return
+		}
+		if err != nil {
+			logger.Error("Unable to save profiles", zap.String("profiles_file", profilesFile), zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Profile deleted but not saved: " + err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "profile deleted"})
+	})
+
+	cfgAPI.POST("/profiles/:name/activate", func(c *gin.Context) {
+		profilesMutex.Lock()
+		profile, ok := profiles[c.Param("name")]
+		profilesMutex.Unlock()
+
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Unknown profile " + c.Param("name")})
+			return
+		}
+
+		profile.profile = c.Param("name")
+		applyConfig(profile, logger, "profile")
+
+		c.JSON(http.StatusOK, gin.H{"status": "profile activated", "active_profile": profile.profile})
+	})
+
+	// the kill switch only flips GloballyDisabled of the live configuration
+	setDisabled := func(disabled bool) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			configMutex.Lock()
+			config.GloballyDisabled = disabled
+			configMutex.Unlock()
+
+			logger.Warn("Fault injection kill switch changed", zap.Bool("globally_disabled", disabled))
+
+			c.JSON(http.StatusOK, gin.H{"status": "configuration updated", "globally_disabled": disabled})
+		}
+	}
+
+	cfgAPI.POST("/disable", setDisabled(true))
+	cfgAPI.POST("/enable", setDisabled(false))
+
+	cfgAPI.GET("/captures", func(c *gin.Context) {
+		gzipJSON(c, http.StatusOK, captures.list())
+	})
+
+	cfgAPI.DELETE("/captures", func(c *gin.Context) {
+		captures.clear()
+		c.JSON(http.StatusOK, gin.H{"status": "captures cleared"})
+	})
+
+	// /events streams every fault decision as a server-sent event
+	cfgAPI.GET("/events", func(c *gin.Context) {
+		events, ok := faultEventHub.subscribe()
+		if !ok {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Too many event subscribers"})
+			return
+		}
+		defer faultEventHub.unsubscribe(events)
+
+		// the stream outlives WRITE_TIMEOUT_CFG
+		if err := http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{}); err != nil {
+			logger.Warn("Unable to clear the write deadline of an event stream", zap.Error(err))
+		}
+
+		c.Header("Cache-Control", "no-cache")
+		c.Header("X-Accel-Buffering", "no")
+		c.Stream(func(w io.Writer) bool {
+			select {
+			case event, open := <-events:
+				if !open {
+					return false
+				}
+				c.SSEvent("fault", event)
+				return true
+			case <-c.Request.Context().Done():
+				return false
+			}
+		})
+	})
+
+	cfgAPI.GET("/rewrite", func(c *gin.Context) {
+		requestURL, err := url.Parse(c.Query("path"))
+		if err != nil || requestURL.Path == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "path must be a request path such as /foo"})
+			return
+		}
+
+		configMutex.RLock()
+		pathRewrites := config.PathRewrites
+		backendRoutes := config.BackendRoutes
+		configMutex.RUnlock()
+
+		backend, ok := routedBackend(backendRoutes, strings.ToUpper(c.DefaultQuery("method", http.MethodGet)), requestURL.Path)
+		if !ok {
+			backend = backends[0]
+		}
+
+		targetURL, err := buildTargetURL(backend, rewritePath(pathRewrites, requestURL))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build backend URL"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"path":   requestURL.String(),
+			"target": targetURL.String(),
+		})
+	})
+
+	cfgAPI.POST("/simulate", func(c *gin.Context) {
+		var simRequest SimulationRequest
+		if err := bindStrictJSON(c, &simRequest); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid simulation format: " + err.Error()})
+			return
+		}
+
+		if err := prepareConfig(&simRequest.Config); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if simRequest.Requests <= 0 {
+			simRequest.Requests = 1000
+		}
+		if simRequest.Requests > maxSimulatedRequests {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "requests must not exceed " + strconv.Itoa(maxSimulatedRequests)})
+			return
+		}
+
+		c.JSON(http.StatusOK, simulate(simRequest))
+	})
+
+	cfgAPI.GET("/schedule", func(c *gin.Context) {
+		c.JSON(http.StatusOK, currentScheduleStatus())
+	})
+
+	cfgAPI.POST("/schedule", func(c *gin.Context) {
+		var newSchedule Schedule
+		if err := bindStrictJSON(c, &newSchedule); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid schedule format: " + err.Error()})
+			return
+		}
+
+		if err := prepareSchedule(&newSchedule); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		startSchedule(newSchedule, logger)
+
+		c.JSON(http.StatusOK, gin.H{"status": "schedule started", "steps": len(newSchedule.Steps), "loop": newSchedule.Loop})
+	})
+
+	cfgAPI.DELETE("/schedule", func(c *gin.Context) {
+		stopSchedule()
+
+		c.JSON(http.StatusOK, gin.H{"status": "schedule stopped"})
+	})
+
+	sCfg := &http.Server{
+		Addr:           ip + ":" + portCfg,
+		Handler:        rCfg,
+		ReadTimeout:    time.Duration(readTimeoutCfgInt) * time.Second,
+		WriteTimeout:   time.Duration(writeTimeoutCfgInt) * time.Second,
+		MaxHeaderBytes: 1 << 20,
+		TLSConfig:      tlsConfigCfg,
+	}
+
+	sCfg.RegisterOnShutdown(faultEventHub.close)
+
+	go func() {
+		logger.Info("Starting Bad Proxy Configuration Server",
+			zap.String("version", Version),
+			zap.String("port", portCfg),
+			zap.Bool("tls", tlsConfigCfg != nil),
+		)
+
+		err := listenAndServe(sCfg, tlsCertFileCfg, tlsKeyFileCfg)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Fatal("unable to start the Bad Proxy Configuration Server", zap.Error(err))
+		}
+	}()
+
+	s := &http.Server{
+		Addr:           ip + ":" + port,
+		Handler:        r,
+		ReadTimeout:    time.Duration(readTimeoutInt) * time.Second,
+		WriteTimeout:   time.Duration(writeTimeoutInt) * time.Second,
+		MaxHeaderBytes: 1 << 20,
+		Protocols:      serverProtocols,
+		TLSConfig:      tlsConfig,
+	}
+
+	go func() {
+		err := listenAndServe(s, tlsCertFile, tlsKeyFile)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Fatal(err.Error())
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	<-ctx.Done()
+	stop()
+
+	logger.Info("Shutting down Bad Proxy, draining active requests",
+		zap.Int("grace_period_seconds", shutdownTimeoutInt))
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(shutdownTimeoutInt)*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for name, server := range map[string]*http.Server{"proxy": s, "config": sCfg} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if err := server.Shutdown(shutdownCtx); err != nil {
+				logger.Error("Server did not shut down cleanly", zap.String("server", name), zap.Error(err))
+				return
+			}
+			logger.Info("Server shut down", zap.String("server", name))
+		}()
+	}
+	wg.Wait()
+
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		logger.Error("Failed to flush traces", zap.Error(err))
+	}
+
+	// the last requests since the previous flush are not lost
+	if statsFile != "" {
+		if err := saveStats(statsFile); err != nil {
+			logger.Error("Unable to save statistics", zap.String("stats_file", statsFile), zap.Error(err))
+		}
+	}
+
+	logger.Info("Bad Proxy stopped")
+	_ = faultLogger.Sync()
+	_ = logger.Sync()
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// serverTLSConfig returns the TLS configuration of a server, or nil when
+// neither certFile nor keyFile is set and the server should stay plaintext.
+// envSuffix names the environment variables in errors, e.g. "_CFG".
+func serverTLSConfig(certFile, keyFile, minVersion, envSuffix string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("TLS_CERT_FILE%[1]s and TLS_KEY_FILE%[1]s must be set together", envSuffix)
+	}
+
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("TLS_MIN_VERSION%s must be one of 1.0, 1.1, 1.2 or 1.3", envSuffix)
+	}
+
+	return &tls.Config{MinVersion: version}, nil
+}
+
+// listenAndServe starts server with TLS when a certificate is configured.
+func listenAndServe(server *http.Server, certFile, keyFile string) error {
+	if server.TLSConfig != nil {
+		return server.ListenAndServeTLS(certFile, keyFile)
+	}
+
+	return server.ListenAndServe()
+}
+
+// hijackConn takes over the client connection so a fault can close or
+// reset it. HTTP/2 connections and response writers that cannot be hijacked
+// get the closest equivalent instead: the handler is aborted with
+// http.ErrAbortHandler, which resets the request's HTTP/2 stream or closes
+// the HTTP/1.x connection without completing the response, and hijackConn
+// does not return.
+func hijackConn(c *gin.Context, logger *zap.Logger) net.Conn {
+	if c.Request.ProtoMajor >= 2 {
+		logger.Info("Resetting HTTP/2 stream",
+			zap.String("proto", c.Request.Proto),
+			zap.String("mechanism", "stream_reset"))
+		panic(http.ErrAbortHandler)
+	}
+
+	hijacker, ok := c.Writer.(http.Hijacker)
+	if !ok {
+		logger.Warn("Response writer does not support hijacking, aborting the response instead",
+			zap.String("proto", c.Request.Proto),
+			zap.String("mechanism", "abort_handler"))
+		panic(http.ErrAbortHandler)
+	}
+
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		logger.Warn("Failed to hijack connection, aborting the response instead",
+			zap.String("proto", c.Request.Proto),
+			zap.String("mechanism", "abort_handler"),
+			zap.Error(err))
+		panic(http.ErrAbortHandler)
+	}
+
+	return conn
+}
+
+// resetConn closes conn with SO_LINGER set to zero so the peer receives a
+// TCP RST. Connections that are not TCP fall back to a regular close.
+func resetConn(conn net.Conn, logger *zap.Logger) {
+	netConn := conn
+	if tlsConn, ok := netConn.(*tls.Conn); ok {
+		netConn = tlsConn.NetConn()
+	}
+
+	tcpConn, ok := netConn.(*net.TCPConn)
+	if !ok {
+		logger.Warn("Connection is not TCP, closing without reset")
+		_ = conn.Close()
+		return
+	}
+
+	if err := tcpConn.SetLinger(0); err != nil {
+		logger.Warn("Failed to disable linger", zap.Error(err))
+	}
+	_ = tcpConn.Close()
+}
+
+// requireToken rejects requests that do not carry an
+// "Authorization: Bearer <token>" header matching token.
+func requireToken(token string) gin.HandlerFunc {
+	expected := []byte("Bearer " + token)
+
+	return func(c *gin.Context) {
+		provided := []byte(c.GetHeader("Authorization"))
+		if subtle.ConstantTimeCompare(provided, expected) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// gunzipRequestBody replaces the body of a request sent with
+// "Content-Encoding: gzip" by its decompressed content. The whole body is
+// decompressed up front so that a malformed stream is reported as such.
+func gunzipRequestBody(req *http.Request) error {
+	if !strings.EqualFold(strings.TrimSpace(req.Header.Get("Content-Encoding")), "gzip") {
+		return nil
+	}
+
+	zr, err := gzip.NewReader(req.Body)
+	if err != nil {
+		return err
+	}
+	decoded, err := io.ReadAll(zr)
+	if err != nil {
+		return err
+	}
+
+	req.Body = io.NopCloser(bytes.NewReader(decoded))
+	req.ContentLength = int64(len(decoded))
+	req.Header.Del("Content-Encoding")
+
+	return nil
+}
+
+// bindStrictJSON decodes the JSON request body of c into obj like
+// c.ShouldBindJSON, but rejects fields obj does not have so that a mistyped
+// name is reported instead of silently ignored.
+func bindStrictJSON(c *gin.Context, obj any) error {
+	if c.Request.Body == nil {
+		return errors.New("missing request body")
+	}
+
+	return decodeStrictJSON(c.Request.Body, obj)
+}
+
+// decodeStrictJSON decodes JSON from r into obj, rejecting fields obj does
+// not have.
+func decodeStrictJSON(r io.Reader, obj any) error {
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(obj); err != nil {
+		return errors.New(strings.TrimPrefix(err.Error(), "json: "))
+	}
+
+	return nil
+}
+
+// mergeConfig returns a copy of base with the fields present in the JSON
+// body overwritten. Objects such as status_errors are merged key by key,
+// arrays and every other value replace the current one. The copy is made
+// through JSON so the merge never touches the maps and slices of the live
+// configuration, and the unexported active profile is carried over.
+func mergeConfig(base ProxyConfig, body []byte) (ProxyConfig, error) {
+	var merged ProxyConfig
+
+	data, err := json.Marshal(base)
+	if err != nil {
+		return merged, err
+	}
+	if err := json.Unmarshal(data, &merged); err != nil {
+		return merged, err
+	}
+
+	merged.profile = base.profile
+
+	if err := decodeStrictJSON(bytes.NewReader(body), &merged); err != nil {
+		return merged, err
+	}
+
+	return merged, nil
+}
+
+// gzipJSON writes obj as JSON like c.JSON, gzip compressed when the client
+// accepts it.
+func gzipJSON(c *gin.Context, status int, obj any) {
+	c.Header("Vary", "Accept-Encoding")
+	if !httpguts.HeaderValuesContainsToken(c.Request.Header["Accept-Encoding"], "gzip") {
+		c.JSON(status, obj)
+		return
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(obj); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode response"})
+		return
+	}
+	if err := zw.Close(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compress response"})
+		return
+	}
+
+	c.Header("Content-Encoding", "gzip")
+	c.Data(status, "application/json; charset=utf-8", buf.Bytes())
+}
+
+var (
+	// tracingEnabled is set by setupTracing when an OTLP endpoint is
+	// configured. Without it no spans are created and the incoming trace
+	// headers are forwarded untouched.
+	tracingEnabled bool
+	tracer         = otel.Tracer(Service)
+)
+
+// setupTracing installs an OTLP/HTTP trace exporter configured by the
+// standard OTEL_EXPORTER_OTLP_* environment variables. It does nothing when
+// neither OTEL_EXPORTER_OTLP_ENDPOINT nor OTEL_EXPORTER_OTLP_TRACES_ENDPOINT
+// is set. The returned function flushes and stops the exporter.
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", Service),
+			attribute.String("service.version", Version),
+		)),
+	)
+
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	tracer = provider.Tracer(Service)
+	tracingEnabled = true
+
+	return provider.Shutdown, nil
+}
+
+// hopHeaders are the hop-by-hop headers of RFC 7230 section 6.1. They only
+// apply to a single connection and are not forwarded.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopByHopHeaders deletes the hop-by-hop headers from h, including the
+// ones named in its Connection header.
+func removeHopByHopHeaders(h http.Header) {
+	for _, field := range h["Connection"] {
+		for _, name := range strings.Split(field, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// setForwardedHeaders appends the address of the connecting client to
+// X-Forwarded-For and sets X-Forwarded-Proto and X-Forwarded-Host to the
+// scheme and host the client used. The peer address is used rather than
+// ClientIP, which may already come from X-Forwarded-For.
+func setForwardedHeaders(req *http.Request, c *gin.Context) {
+	clientIP := c.RemoteIP()
+	if prior := req.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+		clientIP = strings.Join(prior, ", ") + ", " + clientIP
+	}
+	req.Header.Set("X-Forwarded-For", clientIP)
+
+	proto := "http"
+	if c.Request.TLS != nil {
+		proto = "https"
+	}
+	req.Header.Set("X-Forwarded-Proto", proto)
+	req.Header.Set("X-Forwarded-Host", c.Request.Host)
+}
+
+// injectTraceContext replaces the trace headers of an outgoing backend
+// request with the proxy span's context so the backend span becomes its
+// child.
+func injectTraceContext(req *http.Request) {
+	if tracingEnabled {
+		otel.GetTextMapPropagator().Inject(req.Context(), propagation.HeaderCarrier(req.Header))
+	}
+}
+
+const (
+	rateLimitWindow = time.Minute
+
+	// rateLimitSweepSize is the number of tracked client IPs above which
+	// idle clients are dropped from clientRequests.
+	rateLimitSweepSize = 10000
+)
+
+var (
+	// clientRequests holds the accepted request times of each client IP
+	// within the last rateLimitWindow and is guarded by clientRequestsMutex.
+	clientRequests      = map[string][]time.Time{}
+	clientRequestsMutex sync.Mutex
+)
+
+// checkRateLimit records a request from clientIP at now unless the client
+// already made limit requests within the sliding window. Rejected requests
+// are not recorded and report how long until the oldest one leaves the
+// window.
+func checkRateLimit(clientIP string, limit int, now time.Time) (time.Duration, bool) {
+	clientRequestsMutex.Lock()
+	defer clientRequestsMutex.Unlock()
+
+	windowStart := now.Add(-rateLimitWindow)
+
+	if len(clientRequests) > rateLimitSweepSize {
+		for ip, times := range clientRequests {
+			if len(times) == 0 || !times[len(times)-1].After(windowStart) {
+				delete(clientRequests, ip)
+			}
+		}
+	}
+
+	times := clientRequests[clientIP]
+	expired := 0
+	for expired < len(times) && !times[expired].After(windowStart) {
+		expired++
+	}
+	times = times[expired:]
+
+	if len(times) >= limit {
+		clientRequests[clientIP] = times
+		return times[0].Sub(windowStart), true
+	}
+
+	clientRequests[clientIP] = append(times, now)
+	return 0, false
+}
+
+// resetRateLimits forgets the request history of every client.
+func resetRateLimits() {
+	clientRequestsMutex.Lock()
+	clear(clientRequests)
+	clientRequestsMutex.Unlock()
+}
+
+const (
+	circuitClosed   = "closed"
+	circuitOpened   = "open"
+	circuitHalfOpen = "half_open"
+)
+
+// CircuitBreaker is the state of the simulated circuit breaker.
+type CircuitBreaker struct {
+	State               string    `json:"state"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	OpenedAt            time.Time `json:"opened_at,omitzero"`
+	Trips               int       `json:"trips"`
+
+	// probeStarted is when the half-open probe request was let through.
+	probeStarted time.Time
+}
+
+var (
+	circuit      = CircuitBreaker{State: circuitClosed}
+	circuitMutex sync.Mutex
+)
+
+// allowCircuit reports whether the breaker is open for a request at now and,
+// if so, how long until the cooldown ends. Once the cooldown has passed the
+// breaker is half-open and lets a single probe request through; another
+// probe is only allowed when the previous one did not report back within a
+// cooldown.
+func allowCircuit(now time.Time, cooldown time.Duration) (time.Duration, bool) {
+	circuitMutex.Lock()
+	defer circuitMutex.Unlock()
+
+	switch circuit.State {
+	case circuitOpened:
+		if remaining := circuit.OpenedAt.Add(cooldown).Sub(now); remaining > 0 {
+			return remaining, true
+		}
+
+		circuit.State = circuitHalfOpen
+		circuit.probeStarted = now
+		return 0, false
+	case circuitHalfOpen:
+		if now.Sub(circuit.probeStarted) < cooldown {
+			return circuit.probeStarted.Add(cooldown).Sub(now), true
+		}
+
+		circuit.probeStarted = now
+		return 0, false
+	}
+
+	return 0, false
+}
+
+// recordCircuit updates the breaker with the outcome of a real backend
+// request.
+func recordCircuit(failed bool, threshold int, now time.Time, logger *zap.Logger) {
+	circuitMutex.Lock()
+	defer circuitMutex.Unlock()
+
+	if !failed {
+		if circuit.State != circuitClosed {
+			logger.Info("Closing circuit breaker")
+		}
+		circuit.State = circuitClosed
+		circuit.ConsecutiveFailures = 0
+		return
+	}
+
+	circuit.ConsecutiveFailures++
+	if circuit.State == circuitHalfOpen || circuit.State == circuitClosed && circuit.ConsecutiveFailures >= threshold {
+		logger.Info("Opening circuit breaker", zap.Int("consecutive_failures", circuit.ConsecutiveFailures))
+		circuit.State = circuitOpened
+		circuit.OpenedAt = now
+		circuit.Trips++
+	}
+}
+
+func circuitState() CircuitBreaker {
+	circuitMutex.Lock()
+	defer circuitMutex.Unlock()
+
+	return circuit
+}
+
+// resetCircuit closes the breaker and forgets its history.
+func resetCircuit() {
+	circuitMutex.Lock()
+	circuit = CircuitBreaker{State: circuitClosed}
+	circuitMutex.Unlock()
+}
+
+const (
+	onSaturatedReject = "reject"
+	onSaturatedQueue  = "queue"
+)
+
+var (
+	// concurrencyHeld counts the requests holding a MaxConcurrency slot. It
+	// counts every request, also while the cap is disabled, so that a new cap
+	// applies to the requests already in flight. concurrencyFreed is closed,
+	// and replaced, whenever a slot is released to wake up queued requests.
+	concurrencyHeld  int
+	concurrencyFreed = make(chan struct{})
+	concurrencyMutex sync.Mutex
+)
+
+// concurrencyInUse returns the number of MaxConcurrency slots held.
+func concurrencyInUse() int {
+	concurrencyMutex.Lock()
+	defer concurrencyMutex.Unlock()
+
+	return concurrencyHeld
+}
+
+// releaseConcurrency gives back a slot taken by acquireConcurrency.
+func releaseConcurrency() {
+	concurrencyMutex.Lock()
+	defer concurrencyMutex.Unlock()
+
+	concurrencyHeld--
+	close(concurrencyFreed)
+	concurrencyFreed = make(chan struct{})
+}
+
+// acquireConcurrency takes one of limit slots, always succeeding when limit
+// is not positive. When all are held it fails right away, or with queue waits
+// up to timeout for a slot to be released. Lowering the limit lets the
+// requests over it finish, and new ones wait until the slots held fit under
+// it again. The returned function releases the slot.
+func acquireConcurrency(ctx context.Context, limit int, queue bool, timeout time.Duration) (func(), bool) {
+	var timer <-chan time.Time
+	for {
+		concurrencyMutex.Lock()
+		if limit <= 0 || concurrencyHeld < limit {
+			concurrencyHeld++
+			concurrencyMutex.Unlock()
+			return sync.OnceFunc(releaseConcurrency), true
+		}
+		freed := concurrencyFreed
+		concurrencyMutex.Unlock()
+
+		if !queue {
+			return nil, false
+		}
+		if timer == nil {
+			t := time.NewTimer(timeout)
+			defer t.Stop()
+			timer = t.C
+		}
+
+		select {
+		case <-freed:
+		case <-timer:
+			return nil, false
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+}
+
+// trackInFlight counts a request as in flight and raises the high-water
+// mark when needed. The returned function ends the request.
+func trackInFlight() func() {
+	current := inFlight.Add(1)
+	for {
+		highest := maxInFlight.Load()
+		if current <= highest || maxInFlight.CompareAndSwap(highest, current) {
+			break
+		}
+	}
+
+	return func() {
+		inFlight.Add(-1)
+	}
+}
+
+// setRequestDeadlines replaces the read and write deadlines the server set
+// for the connection of c, so that timeouts changed through /config apply
+// without restarting the server. Zero durations keep the server's deadline.
+func setRequestDeadlines(c *gin.Context, logger *zap.Logger, read, write time.Duration) {
+	rc := http.NewResponseController(c.Writer)
+	if read > 0 {
+		if err := rc.SetReadDeadline(time.Now().Add(read)); err != nil {
+			logger.Warn("Unable to apply read_timeout", zap.Error(err))
+		}
+	}
+	if write > 0 {
+		if err := rc.SetWriteDeadline(time.Now().Add(write)); err != nil {
+			logger.Warn("Unable to apply write_timeout", zap.Error(err))
+		}
+	}
+}
+
+// requestID returns the correlation id in the REQUEST_ID_HEADER header of r.
+// Requests without one get a new UUID, which is set on r so that the backend
+// receives it as well.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(requestIDHeader); id != "" {
+		return id
+	}
+
+	id := uuid.NewString()
+	r.Header.Set(requestIDHeader, id)
+
+	return id
+}
+
+// proxyRequest applies the configured faults to a request and proxies it to
+// a backend. faultLogger receives one entry per request describing the
+// fault decision.
+func proxyRequest(c *gin.Context, logger *zap.Logger, faultLogger *zap.Logger) {
+	defer trackInFlight()()
+
+	id := requestID(c.Request)
+	c.Header(requestIDHeader, id)
+	logger = logger.With(zap.String("request_id", id))
+	faultLogger = faultLogger.With(zap.String("request_id", id))
+
+	configMutex.RLock()
+	allowedMethods := config.AllowedMethods
+	maxBodyBytes := config.MaxBodyBytes
+	disableWebSocket := config.DisableWebSocket
+	rateLimitPerMin := config.RateLimitPerMin
+	circuitThreshold := config.CircuitThreshold
+	circuitCooldown := time.Duration(cmp.Or(config.CircuitCooldown, 30)) * time.Second
+	faults := config.faultsFor(c.Request.Method, c.Request.URL.Path)
+	targeted := !config.GloballyDisabled && matchHeaders(c.Request.Header, config.MatchHeaders) &&
+		matchQuery(c.Request.URL.RawQuery, config.MatchQuery)
+	if !targeted {
+		// requests outside of match_headers or match_query, or all of them
+		// while faults are globally disabled, pass through untouched; the
+		// rate limit and circuit breaker ignore them as well
+		faults = FaultConfig{}
+		rateLimitPerMin, circuitThreshold = 0, 0
+	}
+	latency := faults.latencyMs()
+	errorLatency := faults.errorLatencyMs(latency)
+	connectLatency := faults.connectLatencyMs()
+	noBackendProb := faults.NoBackend
+	statusErrorProbs := faults.statusErrors()
+	disconnectProb := faults.Disconnect
+	resetProb := faults.Reset
+	corruptProb := faults.Corrupt
+	weights := faults.faultWeights()
+	force := config.forcePolicy()
+	burst := config.burstPolicy()
+	allowHeaderOverride := config.AllowHeaderOverride && !config.GloballyDisabled
+	exposeFaultHeader := config.ExposeFaultHeader
+	pathRewrites := config.PathRewrites
+	mockResponses := config.MockResponses
+	backendRoutes := config.BackendRoutes
+	forwardedHeaders := !config.DisableForwardedHeaders
+	captureEnabled := config.CaptureEnabled
+	captureLimit := cmp.Or(config.CaptureLimit, 100)
+	captureBodyBytes := cmp.Or(config.CaptureBodyBytes, 1024)
+	maxConcurrency := config.MaxConcurrency
+	requestReadTimeout := time.Duration(config.ReadTimeout) * time.Second
+	requestWriteTimeout := time.Duration(config.WriteTimeout) * time.Second
+	queueSaturated := config.OnSaturated == onSaturatedQueue
+	queueTimeout := time.Duration(cmp.Or(config.QueueTimeoutMs, 1000)) * time.Millisecond
+	configMutex.RUnlock()
+
+	setRequestDeadlines(c, logger, requestReadTimeout, requestWriteTimeout)
+
+	release, acquired := acquireConcurrency(c.Request.Context(), maxConcurrency, queueSaturated, queueTimeout)
+	if !acquired {
+		counters.add("concurrency_rejected", 1)
+
+		logger.Info("Rejecting request over max_concurrency",
+			zap.Int("max_concurrency", maxConcurrency),
+			zap.Bool("queued", queueSaturated))
+
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Too many concurrent requests"})
+		return
+	}
+	defer release()
+
+	var override *faultOverride
+	if value := c.GetHeader(faultOverrideHeader); allowHeaderOverride && value != "" {
+		parsed, err := parseFaultOverride(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + faultOverrideHeader + " header: " + err.Error()})
+			return
+		}
+		override = &parsed
+
+		logger.Info("Forcing fault from request header",
+			zap.String("header", value),
+			zap.String("error_type", cmp.Or(override.errorType, "none")))
+
+		// the header is meant for the proxy only
+		c.Request.Header.Del(faultOverrideHeader)
+		if override.hasLatency {
+			latency, errorLatency = override.latencyMs, override.latencyMs
+		}
+	}
+
+	if len(allowedMethods) > 0 && !slices.Contains(allowedMethods, c.Request.Method) {
+		c.JSON(http.StatusMethodNotAllowed, gin.H{"error": "Method " + c.Request.Method + " is not allowed"})
+		return
+	}
+
+	if maxBodyBytes > 0 && c.Request.ContentLength > maxBodyBytes {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Request body too large"})
+		return
+	}
+
+	webSocket := isWebSocketUpgrade(c.Request)
+	if webSocket && disableWebSocket {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "WebSocket proxying is disabled"})
+		return
+	}
+	if webSocket && mode == modeMock {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "WebSocket upgrades are not supported in mock mode"})
+		return
+	}
+
+	start := time.Now()
+	defer func() {
+		requestLatency.record(time.Since(start))
+	}()
+
+	// the connect latency comes before anything is decided, like a slow
+	// connection setup; the response latency below is added to it
+	if connectLatency > 0 {
+		logger.Info("Delaying connection",
+			zap.Int("connect_latency_ms", connectLatency))
+
+		time.Sleep(time.Duration(connectLatency) * time.Millisecond)
+	}
+
+	var retryAfter time.Duration
+	rateLimited := false
+	if override == nil && rateLimitPerMin > 0 {
+		retryAfter, rateLimited = checkRateLimit(c.ClientIP(), rateLimitPerMin, time.Now())
+	}
+
+	circuitOpen := false
+	if override == nil && !rateLimited && circuitThreshold > 0 {
+		retryAfter, circuitOpen = allowCircuit(time.Now(), circuitCooldown)
+	}
+
+	// a decision that reads the forced error streak or the burst holds
+	// statsMutex until its outcome is in the window, so concurrent requests
+	// never see the same streak and skip or repeat a forced error. Other
+	// targeted requests hold it for the constant-time window write only.
+	decided := override == nil && !rateLimited && !circuitOpen
+	stateful := decided && (force.enabled || burst.enabled)
+	now := time.Now()
+	if stateful || targeted {
+		statsMutex.Lock()
+	}
+
+	var errorType string
+	switch {
+	case override != nil:
+		errorType = override.errorType
+	case rateLimited:
+		errorType = "rate_limited"
+	case circuitOpen:
+		errorType = "circuit_open"
+	default:
+		successiveNoErrors := 0
+		inBurst := false
+		if stateful {
+			successiveNoErrors = stats.successiveNoErrors(now)
+			inBurst = stats.BurstRemaining > 0
+		}
+		errorType = decideErrorType(rng, successiveNoErrors, burst.weights(weights, inBurst), force)
+	}
+
+	// a fault this request cannot get is counted as passed through, so the
+	// stats match what the backend and the client saw
+	if !faultApplies(errorType, c.Request) {
+		errorType = ""
+	}
+
+	// untargeted traffic would dilute the rates and the forced error streak
+	// of the targeted requests, so it is only counted
+	if targeted {
+		stats.recordRecent(errorType, now)
+		if decided {
+			recordBurst(&stats, errorType, burst)
+		}
+	}
+	if stateful || targeted {
+		statsMutex.Unlock()
+	}
+
+	// requestNum comes from the counter; log lines and faults use it instead
+	// of reading the total, which other requests keep changing
+	requestNum := counters.count(errorType)
+	pathCountersFor(c.Request.URL.Path).count(errorType)
+
+	if exposeFaultHeader {
+		c.Header(faultOverrideHeader, cmp.Or(errorType, "none"))
+	}
+
+	var span trace.Span
+	if tracingEnabled {
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		ctx, span = tracer.Start(ctx, "proxy "+c.Request.Method, trace.WithSpanKind(trace.SpanKindServer))
+		c.Request = c.Request.WithContext(ctx)
+	}
+
+	if captureEnabled {
+		requestBody, responseBody := &captureBuffer{limit: captureBodyBytes}, &captureBuffer{limit: captureBodyBytes}
+		requestHeaders := c.Request.Header.Clone()
+		if c.Request.Body != http.NoBody {
+			c.Request.Body = captureReader{ReadCloser: c.Request.Body, buf: requestBody}
+		}
+		c.Writer = captureWriter{ResponseWriter: c.Writer, buf: responseBody}
+
+		defer func() {
+			captures.add(Capture{
+				Time:                  start,
+				RequestNum:            requestNum,
+				Method:                c.Request.Method,
+				Path:                  c.Request.URL.Path,
+				Query:                 c.Request.URL.RawQuery,
+				FaultType:             cmp.Or(errorType, "none"),
+				Status:                c.Writer.Status(),
+				DurationMs:            time.Since(start).Milliseconds(),
+				RequestHeaders:        requestHeaders,
+				RequestBody:           string(requestBody.data),
+				RequestBodyTruncated:  requestBody.truncated,
+				ResponseHeaders:       c.Writer.Header().Clone(),
+				ResponseBody:          string(responseBody.data),
+				ResponseBodyTruncated: responseBody.truncated,
+			}, captureLimit)
+		}()
+	}
+
+	appliedLatencyMs := connectLatency
+	backendStatus := 0
+	defer func() {
+		appliedLatency.Observe(float64(appliedLatencyMs) / 1000)
+
+		if span != nil {
+			span.SetAttributes(
+				attribute.String("http.request.method", c.Request.Method),
+				attribute.String("url.path", c.Request.URL.Path),
+				attribute.String("bad_proxy.fault", cmp.Or(errorType, "none")),
+				attribute.Int("bad_proxy.applied_latency_ms", appliedLatencyMs),
+				attribute.Int("bad_proxy.backend_status", backendStatus),
+			)
+			span.End()
+		}
+
+		faultLogger.Info("Fault decision",
+			zap.Int("request_num", requestNum),
+			zap.String("method", c.Request.Method),
+			zap.String("path", c.Request.URL.Path),
+			zap.String("error_type", cmp.Or(errorType, "none")),
+			zap.Int("applied_latency_ms", appliedLatencyMs),
+			zap.Int("backend_status", backendStatus),
+			zap.Int("bytes_written", max(0, c.Writer.Size())))
+
+		event := faultEvent{
+			Timestamp:  start,
+			Path:       c.Request.URL.Path,
+			FaultType:  cmp.Or(errorType, "none"),
+			RequestNum: requestNum,
+			RequestID:  id,
+		}
+		faultEventHub.publish(event)
+		if errorType != "" {
+			sendFaultEvent(event)
+		}
+	}()
+
+	if rateLimited {
+		retryAfterSeconds := int(math.Ceil(retryAfter.Seconds()))
+
+		logger.Info("Rate limiting client",
+			zap.Int("request_num", requestNum),
+			zap.String("client_ip", c.ClientIP()),
+			zap.Int("rate_limit_per_min", rateLimitPerMin),
+			zap.Int("retry_after_seconds", retryAfterSeconds))
+
+		c.Header("Retry-After", strconv.Itoa(retryAfterSeconds))
+		if faults.RateLimitHeaders {
+			setRateLimitHeaders(c.Writer.Header(), rateLimitPerMin, retryAfterSeconds)
+		}
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too Many Requests"})
+		return
+	}
+
+	if circuitOpen {
+		retryAfterSeconds := int(math.Ceil(retryAfter.Seconds()))
+
+		logger.Info("Short-circuiting request, circuit breaker is open",
+			zap.Int("request_num", requestNum),
+			zap.Int("retry_after_seconds", retryAfterSeconds))
+
+		c.Header("Retry-After", strconv.Itoa(retryAfterSeconds))
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Circuit breaker is open"})
+		return
+	}
+
+	// reset, no_backend and status errors answer the WebSocket handshake like
+	// any other request, the remaining faults are applied to the tunnel
+	_, statusError := statusErrorCode(errorType)
+	if webSocket && !statusError && !slices.Contains([]string{"reset", "tarpit", "no_backend", "bad_status_line"}, errorType) {
+		proxyWebSocket(c, logger, backendFor(backendRoutes, c.Request), backendRequestURL(c, logger, pathRewrites), forwardedHeaders, faults, errorType == "disconnect", latency)
+		return
+	}
+
+	if errorType == "disconnect" && !faults.DisconnectAfterHeaders {
+		logger.Info("Disconnecting based on configured probability",
+			zap.Int("request_num", requestNum),
+			zap.Float64("disconnect", disconnectProb),
+			zap.Int("connect_latency_ms", connectLatency))
+
+		_ = hijackConn(c, logger).Close()
+		c.Abort()
+		return
+	}
+
+	if errorType == "reset" {
+		logger.Info("Resetting connection based on configured probability",
+			zap.Int("request_num", requestNum),
+			zap.Float64("reset", resetProb),
+			zap.Int("connect_latency_ms", connectLatency))
+
+		resetConn(hijackConn(c, logger), logger)
+		c.Abort()
+		return
+	}
+
+	if errorType == "tarpit" {
+		logger.Info("Tarpitting request based on configured probability",
+			zap.Int("request_num", requestNum),
+			zap.Float64("tarpit", faults.Tarpit),
+			zap.Int("tarpit_max_ms", faults.TarpitMaxMs))
+
+		start := time.Now()
+		hang(c.Request.Context(), time.Duration(faults.TarpitMaxMs)*time.Millisecond)
+		logger.Info("Releasing tarpitted request",
+			zap.Int("request_num", requestNum),
+			zap.Duration("held", time.Since(start)),
+			zap.Bool("client_gave_up", c.Request.Context().Err() != nil))
+
+		// nothing was written, closing the connection aborts the request
+		_ = hijackConn(c, logger).Close()
+		c.Abort()
+		return
+	}
+
+	if errorType == "no_backend" {
+		logger.Info("Preventing backend request based on configured probability",
+			zap.Int("request_num", requestNum),
+			zap.Float64("no_backend", noBackendProb),
+			zap.Int("latency_ms", errorLatency),
+			zap.Int("connect_latency_ms", connectLatency))
+
+		appliedLatencyMs += errorLatency
+		time.Sleep(time.Duration(errorLatency) * time.Millisecond)
+		status := cmp.Or(faults.NoBackendStatus, http.StatusOK)
+		if faults.NoBackendBody != "" {
+			c.Data(status, cmp.Or(faults.ErrorContentType, "application/json"), []byte(faults.NoBackendBody))
+			return
+		}
+
+		c.JSON(status, gin.H{"message": "Response generated by Bad-Proxy without reaching backend"})
+		return
+	}
+
+	if errorType == "bad_status_line" {
+		appliedLatencyMs += errorLatency
+		time.Sleep(time.Duration(errorLatency) * time.Millisecond)
+
+		conn := hijackConn(c, logger)
+		mode, err := writeBadStatusLine(conn, faults.BadStatusLineModes)
+		logger.Info("Writing a malformed status line based on configured probability",
+			zap.Int("request_num", requestNum),
+			zap.Float64("bad_status_line", faults.BadStatusLine),
+			zap.String("mode", mode),
+			zap.Int("latency_ms", errorLatency),
+			zap.Int("connect_latency_ms", connectLatency),
+			zap.Error(err))
+
+		_ = conn.Close()
+		c.Abort()
+		return
+	}
+
+	if code, ok := statusErrorCode(errorType); ok {
+		logger.Info("Returning "+strconv.Itoa(code)+" "+http.StatusText(code)+" based on configured probability",
+			zap.Int("request_num", requestNum),
+			zap.Float64(errorType, statusErrorProbs[code]),
+			zap.Int("latency_ms", errorLatency),
+			zap.Int("connect_latency_ms", connectLatency))
+
+		appliedLatencyMs += errorLatency
+		time.Sleep(time.Duration(errorLatency) * time.Millisecond)
+		faults.setBackoffHeaders(c.Writer.Header(), code)
+		if body, contentType := faults.statusErrorBody(code); body != "" {
+			c.Data(code, contentType, []byte(body))
+			return
+		}
+
+		c.JSON(code, gin.H{"error": statusErrorMessage(code)})
+		return
+	}
+
+	if latency > 0 {
+		logger.Info("Delaying proxied request",
+			zap.Int("request_num", requestNum),
+			zap.Int("latency_ms", latency),
+			zap.Int("connect_latency_ms", connectLatency))
+
+		appliedLatencyMs += latency
+		time.Sleep(time.Duration(latency) * time.Millisecond)
+	}
+
+	if mock, ok := mockResponseFor(mockResponses, c.Request.URL.Path); ok {
+		status := cmp.Or(mock.Status, http.StatusOK)
+		logger.Info("Returning mock response",
+			zap.Int("request_num", requestNum),
+			zap.String("path", mock.Path),
+			zap.Int("status", status))
+
+		c.Data(status, cmp.Or(mock.ContentType, "application/json"), []byte(mock.Body))
+		return
+	}
+
+	requestURL := backendRequestURL(c, logger, pathRewrites)
+	targetURL, err := buildTargetURL(backendFor(backendRoutes, c.Request), requestURL)
+	if err != nil {
+		logger.Error("Failed to build backend URL", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build backend URL"})
+		return
+	}
+
+	// the request body is streamed to the backend instead of being buffered
+	requestBody := c.Request.Body
+	if maxBodyBytes > 0 && requestBody != http.NoBody {
+		requestBody = http.MaxBytesReader(c.Writer, requestBody, maxBodyBytes)
+	}
+
+	// the shadow backend gets the body as the primary backend read it
+	var shadowBody *shadowBuffer
+	if shadowRequests != nil {
+		shadowBody = &shadowBuffer{expected: c.Request.ContentLength}
+		if requestBody == http.NoBody {
+			shadowBody.eof = true
+		} else {
+			requestBody = shadowReader{ReadCloser: requestBody, buf: shadowBody}
+		}
+	}
+
+	var uploadCut *uploadCutReader
+	if errorType == "upload_disconnect" {
+		if requestBody == http.NoBody {
+			logger.Info("Disconnecting request without a body based on configured upload disconnect probability",
+				zap.Int("request_num", requestNum),
+				zap.Float64("upload_disconnect", faults.UploadDisconnect))
+
+			_ = hijackConn(c, logger).Close()
+			c.Abort()
+			return
+		}
+
+		uploadCut = &uploadCutReader{ReadCloser: requestBody, remaining: faults.UploadDisconnectBytes}
+		requestBody = uploadCut
+	}
+
+	requestLength := c.Request.ContentLength
+	if errorType == "request_corrupt" && requestBody != http.NoBody {
+		// the body is altered as a whole, so it is buffered instead of
+		// streamed
+		body, err := io.ReadAll(requestBody)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Request body too large"})
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to read request body for request_corrupt", zap.Error(err))
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+			return
+		}
+
+		mode := cmp.Or(faults.RequestCorruptMode, corruptTruncate)
+		corrupted, altered := body, 0
+		if len(body) > 0 {
+			corrupted, altered = corruptBody(body, mode, "", faults)
+		}
+
+		logger.Info("Corrupting request body based on configured probability",
+			zap.Int("request_num", requestNum),
+			zap.Float64("request_corrupt", faults.RequestCorrupt),
+			zap.String("mode", mode),
+			zap.Int("original_length", len(body)),
+			zap.Int("corrupted_length", len(corrupted)),
+			zap.Int("altered_bytes", altered))
+
+		requestBody = io.NopCloser(bytes.NewReader(corrupted))
+		requestLength = int64(len(corrupted))
+	}
+
+	// the backend call is cancelled when the client connection goes away or
+	// BACKEND_TIMEOUT expires
+	backendCtx := c.Request.Context()
+	if backendDeadline > 0 {
+		var cancel context.CancelFunc
+		backendCtx, cancel = context.WithTimeout(backendCtx, backendDeadline)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(backendCtx, c.Request.Method, targetURL.String(), requestBody)
+	if err != nil {
+		logger.Error("Failed to create proxy request", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create proxy request"})
+		return
+	}
+
+	req.ContentLength = requestLength
+
+	for name, values := range c.Request.Header {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+
+	// gRPC needs "TE: trailers" to reach the backend even though TE is
+	// hop-by-hop
+	teTrailers := httpguts.HeaderValuesContainsToken(req.Header["Te"], "trailers")
+	removeHopByHopHeaders(req.Header)
+	if teTrailers {
+		req.Header.Set("Te", "trailers")
+	}
+
+	// without the client's Accept-Encoding the transport asks for gzip
+	// itself and decodes it, so bad_encoding gets a body it can re-encode
+	if errorType == "bad_encoding" {
+		req.Header.Del("Accept-Encoding")
+	}
+
+	if forwardedHeaders {
+		setForwardedHeaders(req, c)
+	}
+	injectTraceContext(req)
+
+	if shadowBody != nil {
+		shadowHeader := req.Header.Clone()
+		defer func() {
+			body, complete := shadowBody.contents()
+			if !complete {
+				logger.Info("Not mirroring a request whose body was not read completely or is too large",
+					zap.Int("request_num", requestNum))
+				return
+			}
+
+			shadowURL, err := buildTargetURL(shadowBackendURL, requestURL)
+			if err != nil {
+				logger.Error("Failed to build shadow backend URL", zap.Error(err))
+				return
+			}
+
+			sendShadowRequest(shadowRequest{
+				method:        c.Request.Method,
+				url:           shadowURL.String(),
+				header:        shadowHeader,
+				body:          body,
+				path:          c.Request.URL.Path,
+				requestID:     id,
+				primaryStatus: backendStatus,
+			})
+		}()
+	}
+
+	resp, err := proxyClient.Do(req)
+	if err != nil && c.Request.Context().Err() != nil {
+		logger.Info("Client cancelled request before the backend responded",
+			zap.Int("request_num", requestNum),
+			zap.Error(err))
+		c.Abort()
+		return
+	}
+	if uploadCut != nil && uploadCut.cut.Load() {
+		logger.Info("Disconnecting during upload based on configured probability",
+			zap.Int("request_num", requestNum),
+			zap.Float64("upload_disconnect", faults.UploadDisconnect),
+			zap.Int64("bytes_consumed", uploadCut.consumed.Load()))
+
+		_ = hijackConn(c, logger).Close()
+		c.Abort()
+		return
+	}
+	if uploadCut != nil {
+		logger.Info("Request body ended before the upload disconnect point",
+			zap.Int("request_num", requestNum),
+			zap.Int64("bytes_consumed", uploadCut.consumed.Load()),
+			zap.Int64("upload_disconnect_bytes", faults.UploadDisconnectBytes))
+	}
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Request body too large"})
+		return
+	}
+	if err != nil && errors.Is(backendCtx.Err(), context.DeadlineExceeded) {
+		if circuitThreshold > 0 {
+			recordCircuit(true, circuitThreshold, time.Now(), logger)
+		}
+		recordBackendFailure(c.Request.URL.Path, backendFailureTimeout)
+
+		logger.Warn("Backend request timed out",
+			zap.Int("request_num", requestNum),
+			zap.Duration("backend_timeout", backendDeadline),
+			zap.Int("status", backendTimeoutCode))
+		c.JSON(backendTimeoutCode, gin.H{"error": "Backend request timed out"})
+		return
+	}
+	if err != nil {
+		if circuitThreshold > 0 {
+			recordCircuit(true, circuitThreshold, time.Now(), logger)
+		}
+		recordBackendFailure(c.Request.URL.Path, backendFailureUnreachable)
+
+		logger.Error("Failed to execute proxy request", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to execute proxy request"})
+		return
+	}
+	defer func(Body io.ReadCloser) {
+		err := Body.Close()
+		if err != nil {
+			logger.Error("Failed to close response body", zap.Error(err))
+		}
+	}(resp.Body)
+	backendStatus = resp.StatusCode
+	if resp.StatusCode >= http.StatusInternalServerError {
+		recordBackendFailure(c.Request.URL.Path, backendFailureError)
+	}
+
+	if circuitThreshold > 0 {
+		recordCircuit(resp.StatusCode >= http.StatusInternalServerError, circuitThreshold, time.Now(), logger)
+	}
+
+	if faults.LatencyPerKBMs > 0 && c.Request.Method != http.MethodHead {
+		size := resp.ContentLength
+		if size < 0 {
+			// the size of a chunked body is only known once it is read
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				logger.Error("Failed to read response body for size latency", zap.Error(err))
+				c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to read backend response"})
+				return
+			}
+			resp.Body = io.NopCloser(bytes.NewReader(body))
+			size = int64(len(body))
+		}
+
+		sizeLatency := int(float64(size) / 1024 * faults.LatencyPerKBMs)
+		logger.Info("Delaying response based on its size",
+			zap.Int("request_num", requestNum),
+			zap.Int64("body_bytes", size),
+			zap.Float64("latency_per_kb_ms", faults.LatencyPerKBMs),
+			zap.Int("size_latency_ms", sizeLatency))
+
+		appliedLatencyMs += sizeLatency
+		time.Sleep(time.Duration(sizeLatency) * time.Millisecond)
+	}
+
+	if errorType == "corrupt" && len(faults.CorruptOnlyStatus) > 0 && !slices.Contains(faults.CorruptOnlyStatus, resp.StatusCode) {
+		// the decision stays counted, but the response is left intact so an
+		// error of the backend is not faulted twice
+		logger.Info("Not corrupting a response outside of corrupt_only_status",
+			zap.Int("request_num", requestNum),
+			zap.Int("backend_status", resp.StatusCode),
+			zap.Ints("corrupt_only_status", faults.CorruptOnlyStatus))
+
+		errorType = ""
+		if exposeFaultHeader {
+			c.Header(faultOverrideHeader, "none")
+		}
+	}
+
+	// corrupt, partial_hang and bad_encoding work on the whole body, which is
+	// read before the status is committed so a failed read still gets an
+	// error response
+	var responseBody []byte
+	if (errorType == "corrupt" || errorType == "partial_hang" || errorType == "bad_encoding") && c.Request.Method != http.MethodHead {
+		responseBody, err = io.ReadAll(resp.Body)
+		if err != nil {
+			logger.Error("Failed to read response body for "+errorType, zap.Error(err))
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to read backend response"})
+			return
+		}
+	}
+
+	if errorType == "bad_encoding" {
+		encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+		body, newEncoding, mode := reencodeBody(responseBody, encoding, faults.BadEncodingModes)
+
+		logger.Info("Re-encoding response based on configured probability",
+			zap.Int("request_num", requestNum),
+			zap.Float64("bad_encoding", faults.BadEncoding),
+			zap.String("mode", mode),
+			zap.String("content_encoding", encoding),
+			zap.String("sent_content_encoding", newEncoding),
+			zap.Int("original_length", len(responseBody)),
+			zap.Int("sent_length", len(body)))
+
+		responseBody = body
+		resp.Header.Set("Content-Encoding", newEncoding)
+		resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+
+	removeHopByHopHeaders(resp.Header)
+	if resp.Header.Get(requestIDHeader) != "" {
+		// the backend's own correlation id replaces the one set for injected
+		// responses
+		c.Writer.Header().Del(requestIDHeader)
+	}
+	if exposeFaultHeader {
+		// e.g. a chained bad-proxy reports its own fault
+		resp.Header.Del(faultOverrideHeader)
+	}
+	for name, values := range resp.Header {
+		for _, value := range values {
+			c.Writer.Header().Add(name, value)
+		}
+	}
+
+	// the Trailer header was dropped as hop-by-hop, announce the trailers
+	// the backend declared again; their values are set after the body
+	if len(resp.Trailer) > 0 {
+		c.Writer.Header().Set("Trailer", strings.Join(slices.Sorted(maps.Keys(resp.Trailer)), ", "))
+	}
+
+	for name, value := range faults.InjectHeaders {
+		if value == deleteHeader {
+			c.Writer.Header().Del(name)
+			continue
+		}
+		c.Header(name, value)
+	}
+
+	if errorType == "header_corrupt" {
+		applied := corruptHeaders(c.Writer.Header(), faults.HeaderCorruptActions)
+
+		logger.Info("Corrupting response headers based on configured probability",
+			zap.Int("request_num", requestNum),
+			zap.Float64("header_corrupt", faults.HeaderCorrupt),
+			zap.Strings("actions", applied))
+	}
+
+	if faults.HeaderLatencyMs > 0 {
+		logger.Info("Delaying response headers",
+			zap.Int("request_num", requestNum),
+			zap.Int("header_latency_ms", faults.HeaderLatencyMs))
+
+		appliedLatencyMs += faults.HeaderLatencyMs
+		time.Sleep(time.Duration(faults.HeaderLatencyMs) * time.Millisecond)
+	}
+
+	c.Status(resp.StatusCode)
+
+	if errorType == "header_corrupt" || faults.HeaderLatencyMs > 0 {
+		// send the headers right away: mangled ones so net/http cannot
+		// restore a dropped Content-Length for small bodies, delayed ones so
+		// the first byte arrives after the header latency and not with the
+		// body
+		c.Writer.Flush()
+	}
+
+	// responses to HEAD requests must not carry a body
+	if c.Request.Method == http.MethodHead {
+		return
+	}
+
+	var dst io.Writer = c.Writer
+	if protocol == protocolH2C {
+		// forward streamed messages as soon as they arrive
+		dst = flushWriter{c.Writer}
+	}
+	if faults.MaxKBps > 0 {
+		dst = newThrottledWriter(c.Request.Context(), c.Writer, faults.MaxKBps*1024)
+
+		throttleStart := time.Now()
+		defer func() {
+			logger.Info("Throttled response body",
+				zap.Int("request_num", requestNum),
+				zap.Int("max_kbps", faults.MaxKBps),
+				zap.Int("bytes", c.Writer.Size()),
+				zap.Duration("elapsed", time.Since(throttleStart)))
+		}()
+	}
+
+	if errorType == "corrupt" {
+		logger.Info("Corrupting response based on configured probability",
+			zap.Int("request_num", requestNum),
+			zap.Float64("corrupt", corruptProb),
+			zap.Int("latency_ms", latency))
+
+		originalLength := len(responseBody)
+		if originalLength > 0 {
+			mode := faults.CorruptMode
+			if mode == "" {
+				mode = corruptTruncate
+			}
+
+			encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+			if mode == corruptCompressed && compressedTrailerSize(encoding, originalLength) == 0 {
+				// plain bodies get the default corruption
+				mode = corruptTruncate
+			}
+
+			corrupted, altered := corruptBody(responseBody, mode, encoding, faults)
+
+			logger.Info("Corrupting response body",
+				zap.String("mode", mode),
+				zap.String("content_encoding", encoding),
+				zap.Int("original_length", originalLength),
+				zap.Int("corrupted_length", len(corrupted)),
+				zap.Int("altered_bytes", altered),
+				zap.Bool("fix_content_length", faults.CorruptFixContentLength))
+
+			if mode == corruptInflate {
+				counters.inflatedBytes.Add(int64(altered))
+			}
+
+			// a chunked response has no length to fix
+			declaredLength := c.Writer.Header().Get("Content-Length") != ""
+			if faults.CorruptFixContentLength && declaredLength {
+				c.Writer.Header().Set("Content-Length", strconv.Itoa(len(corrupted)))
+			}
+
+			if mode == corruptInflate && declaredLength && !faults.CorruptFixContentLength {
+				writeInflated(c, logger, dst, corrupted, originalLength)
+				return
+			}
+
+			_, err = dst.Write(corrupted)
+			if err != nil {
+				logger.Error("Failed to write corrupted response", zap.Error(err))
+			}
+		}
+	} else if errorType == "bad_encoding" {
+		_, err = dst.Write(responseBody)
+		if err != nil {
+			logger.Error("Failed to write re-encoded response", zap.Error(err))
+		}
+	} else if errorType == "partial_hang" {
+		fraction := faults.PartialHangFraction
+		if fraction == 0 {
+			fraction = 0.5
+		}
+		written := int(float64(len(responseBody)) * fraction)
+
+		logger.Info("Writing partial response and hanging based on configured probability",
+			zap.Int("request_num", requestNum),
+			zap.Float64("partial_hang", faults.PartialHang),
+			zap.Int("original_length", len(responseBody)),
+			zap.Int("written_length", written),
+			zap.Int("hang_ms", faults.PartialHangMs))
+
+		_, err = dst.Write(responseBody[:written])
+		if err != nil {
+			logger.Error("Failed to write partial response", zap.Error(err))
+			return
+		}
+		c.Writer.Flush()
+
+		hang(c.Request.Context(), time.Duration(faults.PartialHangMs)*time.Millisecond)
+
+		// never complete the response; closing the connection tells the
+		// client the body was cut short
+		_ = hijackConn(c, logger).Close()
+		c.Abort()
+	} else if errorType == "disconnect" {
+		written, err := io.CopyN(dst, resp.Body, faults.DisconnectAfterBytes)
+		if err != nil && !errors.Is(err, io.EOF) {
+			logger.Error("Failed to write response before disconnecting", zap.Error(err))
+		}
+		c.Writer.Flush()
+
+		logger.Info("Disconnecting after the response headers based on configured probability",
+			zap.Int("request_num", requestNum),
+			zap.Float64("disconnect", disconnectProb),
+			zap.Int64("disconnect_after_bytes", faults.DisconnectAfterBytes),
+			zap.Int64("written_length", written))
+
+		_ = hijackConn(c, logger).Close()
+		c.Abort()
+	} else if faults.DripEnabled && faults.DripBytesPerSec > 0 {
+		start := time.Now()
+		written, err := dripCopy(c.Writer, resp.Body, faults.DripBytesPerSec)
+		if err != nil {
+			logger.Error("Failed to drip response body", zap.Error(err))
+		}
+
+		logger.Info("Dripped response body",
+			zap.Int("request_num", requestNum),
+			zap.Int("bytes_per_sec", faults.DripBytesPerSec),
+			zap.Int64("bytes", written),
+			zap.Duration("elapsed", time.Since(start)))
+	} else {
+		_, err = io.Copy(dst, resp.Body)
+		if err != nil {
+			logger.Error("Failed to copy response body", zap.Error(err))
+		}
+	}
+
+	// trailers are only known once the body has been read, e.g. grpc-status
+	for name, values := range resp.Trailer {
+		c.Writer.Header()[http.TrailerPrefix+name] = values
+	}
+}
+
+// throttledWriter limits the rate of writes to a response using a token
+// bucket and flushes after every chunk so the client sees a steady stream.
+type throttledWriter struct {
+	ctx     context.Context
+	w       gin.ResponseWriter
+	limiter *rate.Limiter
+	chunk   int
+}
+
+func newThrottledWriter(ctx context.Context, w gin.ResponseWriter, bytesPerSec int) *throttledWriter {
+	// a tenth of a second worth of bytes per write keeps the output smooth
+	chunk := max(1, bytesPerSec/10)
+
+	return &throttledWriter{
+		ctx:     ctx,
+		w:       w,
+		limiter: rate.NewLimiter(rate.Limit(bytesPerSec), chunk),
+		chunk:   chunk,
+	}
+}
+
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), tw.chunk)
+		if err := tw.limiter.WaitN(tw.ctx, n); err != nil {
+			return written, err
+		}
+
+		m, err := tw.w.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		tw.w.Flush()
+
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+// isWebSocketUpgrade reports whether r asks to upgrade to the WebSocket
+// protocol.
+func isWebSocketUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		httpguts.HeaderValuesContainsToken(r.Header["Connection"], "upgrade")
+}
+
+// backendRequestURL returns the request URL with the path rewrites applied,
+// logging the rewritten path.
+func backendRequestURL(c *gin.Context, logger *zap.Logger, rules []PathRewrite) *url.URL {
+	rewritten := rewritePath(rules, c.Request.URL)
+	if rewritten != c.Request.URL {
+		logger.Info("Rewriting request path",
+			zap.String("path", c.Request.URL.EscapedPath()),
+			zap.String("rewritten_path", rewritten.EscapedPath()))
+	}
+
+	return rewritten
+}
+
+// backendFor returns the backend for r, the one of the first matching backend
+// route or else the next BACKEND_URL backend.
+func backendFor(routes []BackendRoute, r *http.Request) string {
+	if backend, ok := routedBackend(routes, r.Method, r.URL.Path); ok {
+		return backend
+	}
+
+	return nextBackend()
+}
+
+// proxyWebSocket forwards a WebSocket handshake for requestURL to backend
+// and, once the backend switches protocols, tunnels bytes in both
+// directions. Every chunk read from either side is delayed by latencyMs. When
+// disconnect is set the tunnel is closed after a random time up to
+// WebSocketDisconnectMaxMs.
+func proxyWebSocket(c *gin.Context, logger *zap.Logger, backend string, requestURL *url.URL, forwardedHeaders bool, faults FaultConfig, disconnect bool, latencyMs int) {
+	targetURL, err := buildTargetURL(backend, requestURL)
+	if err != nil {
+		logger.Error("Failed to build backend URL", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build backend URL"})
+		return
+	}
+
+	req, err := http.NewRequestWithContext(c.Request.Context(), c.Request.Method, targetURL.String(), nil)
+	if err != nil {
+		logger.Error("Failed to create proxy request", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create proxy request"})
+		return
+	}
+
+	for name, values := range c.Request.Header {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	if forwardedHeaders {
+		setForwardedHeaders(req, c)
+	}
+	injectTraceContext(req)
+
+	resp, err := proxyClient.Do(req)
+	if err != nil {
+		recordBackendFailure(c.Request.URL.Path, backendFailureUnreachable)
+		logger.Error("Failed to execute WebSocket handshake", zap.Error(err))
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to execute WebSocket handshake"})
+		return
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	backendConn, ok := resp.Body.(io.ReadWriteCloser)
+	if resp.StatusCode != http.StatusSwitchingProtocols || !ok {
+		// the backend refused the upgrade, relay its answer as is
+		for name, values := range resp.Header {
+			for _, value := range values {
+				c.Writer.Header().Add(name, value)
+			}
+		}
+		c.Status(resp.StatusCode)
+		_, _ = io.Copy(c.Writer, resp.Body)
+		return
+	}
+
+	hijacker, ok := c.Writer.(http.Hijacker)
+	if !ok {
+		logger.Error("Response writer does not support hijacking")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	clientConn, clientBuf, err := hijacker.Hijack()
+	if err != nil {
+		logger.Error("Failed to hijack connection", zap.Error(err))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	defer func() {
+		_ = clientConn.Close()
+	}()
+	c.Abort()
+
+	_, _ = clientBuf.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	_ = resp.Header.Write(clientBuf)
+	_, _ = clientBuf.WriteString("\r\n")
+	if err := clientBuf.Flush(); err != nil {
+		logger.Error("Failed to write WebSocket handshake response", zap.Error(err))
+		return
+	}
+
+	delay := time.Duration(latencyMs) * time.Millisecond
+	logger.Info("WebSocket tunnel established",
+		zap.String("backend", targetURL.Host),
+		zap.Int("frame_latency_ms", latencyMs),
+		zap.Bool("disconnect", disconnect))
+
+	if disconnect {
+		maxMs := faults.WebSocketDisconnectMaxMs
+		if maxMs <= 0 {
+			maxMs = 5000
+		}
+		after := time.Duration(rng.IntN(maxMs)+1) * time.Millisecond
+
+		timer := time.AfterFunc(after, func() {
+			logger.Info("Closing WebSocket tunnel based on configured probability",
+				zap.Float64("disconnect", faults.Disconnect),
+				zap.Duration("after", after))
+			_ = clientConn.Close()
+			_ = backendConn.Close()
+		})
+		defer timer.Stop()
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		_ = delayedCopy(backendConn, clientBuf, delay)
+		done <- struct{}{}
+	}()
+	go func() {
+		_ = delayedCopy(clientConn, backendConn, delay)
+		done <- struct{}{}
+	}()
+
+	// once either side stops, tear down both so the other copy returns
+	<-done
+	_ = clientConn.Close()
+	_ = backendConn.Close()
+	<-done
+}
+
+// delayedCopy copies src to dst, waiting delay before writing each chunk.
+func delayedCopy(dst io.Writer, src io.Reader, delay time.Duration) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if delay > 0 {
+				time.Sleep(delay)
+			}
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return werr
+			}
+		}
+
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// flushWriter flushes the response after every write.
+type flushWriter struct {
+	w gin.ResponseWriter
+}
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if err == nil {
+		fw.w.Flush()
+	}
+
+	return n, err
+}
+
+var errUploadCut = errors.New("upload cut off by the upload_disconnect fault")
+
+// uploadCutReader passes through the first remaining bytes of a request
+// body and then fails every read, aborting the backend request.
+type uploadCutReader struct {
+	io.ReadCloser
+	remaining int64
+
+	// consumed and cut are read by the handler while the transport may
+	// still be reading the body.
+	consumed atomic.Int64
+	cut      atomic.Bool
+}
+
+func (u *uploadCutReader) Read(p []byte) (int, error) {
+	if u.remaining <= 0 {
+		u.cut.Store(true)
+		return 0, errUploadCut
+	}
+
+	if int64(len(p)) > u.remaining {
+		p = p[:u.remaining]
+	}
+
+	n, err := u.ReadCloser.Read(p)
+	u.remaining -= int64(n)
+	u.consumed.Add(int64(n))
+
+	return n, err
+}
+
+// hang blocks until ctx is done or, when d is positive, d has elapsed.
+func hang(ctx context.Context, d time.Duration) {
+	if d <= 0 {
+		<-ctx.Done()
+		return
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// buildTargetURL returns the backend URL for an incoming request URL. Only
+// the scheme, host and path prefix come from backend; the escaped path
+// (RawPath) and RawQuery of in are preserved exactly so that encoded
+// characters such as %2F reach the backend unchanged.
+func buildTargetURL(backend string, in *url.URL) (*url.URL, error) {
+	target, err := url.Parse(backend)
+	if err != nil {
+		return nil, err
+	}
+
+	out := *in
+	out.Scheme = target.Scheme
+	out.Host = target.Host
+	out.User = target.User
+	out.Path, out.RawPath = joinURLPath(target, in)
+
+	return &out, nil
+}
+
+// joinURLPath joins the paths of a and b with a single slash, keeping the
+// escaped form when either URL carries a RawPath.
+func joinURLPath(a, b *url.URL) (string, string) {
+	if a.RawPath == "" && b.RawPath == "" {
+		return singleJoiningSlash(a.Path, b.Path), ""
+	}
+
+	apath := a.EscapedPath()
+	bpath := b.EscapedPath()
+
+	aslash := strings.HasSuffix(apath, "/")
+	bslash := strings.HasPrefix(bpath, "/")
+
+	switch {
+	case aslash && bslash:
+		return a.Path + b.Path[1:], apath + bpath[1:]
+	case !aslash && !bslash:
+		return a.Path + "/" + b.Path, apath + "/" + bpath
+	}
+
+	return a.Path + b.Path, apath + bpath
+}
+
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash && b != "":
+		return a + "/" + b
+	}
+
+	return a + b
+}
+
+// dripCopy copies src to w in small chunks, flushing after each chunk and
+// sleeping in between so that roughly bytesPerSec bytes are sent per second.
+func dripCopy(w gin.ResponseWriter, src io.Reader, bytesPerSec int) (int64, error) {
+	chunkSize := max(1, bytesPerSec/10)
+	interval := time.Second * time.Duration(chunkSize) / time.Duration(bytesPerSec)
+
+	buf := make([]byte, chunkSize)
+	var written int64
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return written, werr
+			}
+			w.Flush()
+			written += int64(n)
+			time.Sleep(interval)
+		}
+
+		if errors.Is(err, io.EOF) {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+const (
+	corruptTruncate   = "truncate"
+	corruptBitflip    = "bitflip"
+	corruptShuffle    = "shuffle"
+	corruptCompressed = "compressed"
+	corruptInflate    = "inflate"
+)
+
+// corruptBody alters a non-empty body according to mode and returns the
+// corrupted body together with the number of bytes altered. encoding is the
+// response Content-Encoding, used by the compressed mode.
+func corruptBody(body []byte, mode, encoding string, fc FaultConfig) ([]byte, int) {
+	switch mode {
+	case corruptBitflip:
+		return body, bitflipBody(body, fc.CorruptFlipPercent)
+	case corruptShuffle:
+		return body, shuffleBody(body)
+	case corruptInflate:
+		extra := cmp.Or(fc.CorruptInflateBytes, 64)
+		inflated := make([]byte, len(body), len(body)+extra)
+		copy(inflated, body)
+		for range extra {
+			inflated = append(inflated, byte(rng.IntN(256)))
+		}
+		return inflated, extra
+	case corruptCompressed:
+		if size := compressedTrailerSize(encoding, len(body)); size > 0 {
+			// flipping a trailer byte leaves the stream decodable up to
+			// the end, where the checksum or length check fails
+			body[len(body)-size+rng.IntN(size)] ^= 1 << rng.IntN(8)
+			return body, 1
+		}
+	}
+
+	minFraction, maxFraction := fc.corruptFractions()
+	truncated := truncateBody(body, minFraction, maxFraction, fc.CorruptMaxBytes)
+	return truncated, len(body) - len(truncated)
+}
+
+// writeInflated sends an inflated body past the Content-Length announced to
+// the client. The server refuses to write more than the declared length, so
+// the first declared bytes go through dst and the rest straight to the
+// hijacked connection, which is then closed as the stream no longer lines
+// up with HTTP framing.
+func writeInflated(c *gin.Context, logger *zap.Logger, dst io.Writer, body []byte, declared int) {
+	if _, err := dst.Write(body[:declared]); err != nil {
+		logger.Error("Failed to write corrupted response", zap.Error(err))
+		return
+	}
+	c.Writer.Flush()
+
+	conn := hijackConn(c, logger)
+	defer func() { _ = conn.Close() }()
+	c.Abort()
+
+	if _, err := conn.Write(body[declared:]); err != nil {
+		logger.Warn("Failed to write the inflated bytes", zap.Error(err))
+	}
+}
+
+// compressedTrailerSize returns the length of the checksum trailer of a body
+// with the given Content-Encoding: the CRC-32 and size of gzip, or the
+// Adler-32 of zlib for deflate. It returns 0 for other encodings and for
+// bodies too short to hold a trailer.
+func compressedTrailerSize(encoding string, bodyLength int) int {
+	size := 0
+	switch encoding {
+	case "gzip", "x-gzip":
+		size = 8
+	case "deflate":
+		size = 4
+	}
+
+	if bodyLength <= size {
+		return 0
+	}
+	return size
+}
+
+// truncateBody cuts the body to a random length between minFraction and
+// maxFraction of the original length, but no longer than maxBytes when it
+// is positive, always keeping at least one byte.
+func truncateBody(body []byte, minFraction, maxFraction float64, maxBytes int) []byte {
+	originalLength := len(body)
+	minLength := int(float64(originalLength) * minFraction)
+	maxLength := int(float64(originalLength) * maxFraction)
+
+	if minLength < 1 {
+		minLength = 1
+	}
+
+	if maxLength <= minLength {
+		maxLength = minLength + 1
+	}
+
+	truncatedLength := minLength
+	if maxLength > minLength {
+		truncatedLength = minLength + rng.IntN(maxLength-minLength)
+	}
+	if maxBytes > 0 {
+		truncatedLength = min(truncatedLength, maxBytes)
+	}
+
+	return body[:truncatedLength]
+}
+
+// bitflipBody flips one random bit in flipPercent percent of the bytes of
+// body (at least one byte) in place, keeping the length unchanged.
+func bitflipBody(body []byte, flipPercent float64) int {
+	if flipPercent <= 0 {
+		flipPercent = 1
+	}
+
+	flips := int(float64(len(body)) * flipPercent / 100)
+	if flips < 1 {
+		flips = 1
+	}
+
+	for _, i := range rng.Perm(len(body))[:min(flips, len(body))] {
+		body[i] ^= 1 << rng.IntN(8)
+	}
+
+	return min(flips, len(body))
+}
+
+// shuffleBody splits body into up to eight ranges and reorders them in
+// place. It returns the number of bytes that changed position.
+func shuffleBody(body []byte) int {
+	chunkSize := max(1, len(body)/8)
+
+	var chunks [][]byte
+	for start := 0; start < len(body); start += chunkSize {
+		chunks = append(chunks, slices.Clone(body[start:min(start+chunkSize, len(body))]))
+	}
+
+	rng.Shuffle(len(chunks), func(i, j int) {
+		chunks[i], chunks[j] = chunks[j], chunks[i]
+	})
+
+	original := slices.Clone(body)
+	shuffled := slices.Concat(chunks...)
+	copy(body, shuffled)
+
+	altered := 0
+	for i := range body {
+		if body[i] != original[i] {
+			altered++
+		}
+	}
+
+	return altered
+}
+
+const (
+	statusLineHTTP10     = "http10"
+	statusLineNoReason   = "no-reason"
+	statusLineLowercase  = "lowercase"
+	badStatusLineMessage = `{"message":"Response with a malformed status line generated by Bad-Proxy"}`
+)
+
+var badStatusLineModes = []string{statusLineHTTP10, statusLineNoReason, statusLineLowercase}
+
+// writeBadStatusLine writes a complete raw response to conn whose status line
+// is malformed in a random one of modes, or of all modes when empty, and
+// returns the mode used. The response asks the client to close the
+// connection, which the caller then does.
+func writeBadStatusLine(conn net.Conn, modes []string) (string, error) {
+	if len(modes) == 0 {
+		modes = badStatusLineModes
+	}
+	mode := modes[rng.IntN(len(modes))]
+
+	statusLine := "HTTP/1.1 200 OK"
+	switch mode {
+	case statusLineHTTP10:
+		statusLine = "HTTP/1.0 200 OK"
+	case statusLineNoReason:
+		statusLine = "HTTP/1.1 200"
+	case statusLineLowercase:
+		statusLine = "http/1.1 200 OK"
+	}
+
+	_, err := fmt.Fprintf(conn, "%s\r\nContent-Type: application/json\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+		statusLine, len(badStatusLineMessage), badStatusLineMessage)
+	return mode, err
+}
+
+const (
+	encodingFakeGzip   = "fake-gzip"
+	encodingFakeBrotli = "fake-br"
+	encodingDoubleGzip = "double-gzip"
+)
+
+var badEncodingModes = []string{encodingFakeGzip, encodingFakeBrotli, encodingDoubleGzip}
+
+// reencodeBody encodes a body sent with the given Content-Encoding again in
+// a random one of modes, or of all modes when empty, so that it no longer
+// matches the Content-Encoding returned with it: fake-gzip and fake-br only
+// label the decoded body as gzip or br, double-gzip compresses it twice but
+// labels it as gzip once. Bodies that cannot be decoded, such as br or broken
+// gzip, are used as they are, and a mode that would label a body with its own
+// encoding is replaced by double-gzip. It returns the new body, its
+// Content-Encoding and the mode used.
+func reencodeBody(body []byte, encoding string, modes []string) ([]byte, string, string) {
+	plain := body
+	switch encoding {
+	case "identity":
+		encoding = ""
+	case "gzip", "x-gzip":
+		if zr, err := gzip.NewReader(bytes.NewReader(body)); err == nil {
+			if decoded, err := io.ReadAll(zr); err == nil {
+				plain, encoding = decoded, ""
+			}
+		}
+	}
+
+	if len(modes) == 0 {
+		modes = badEncodingModes
+	}
+	mode := modes[rng.IntN(len(modes))]
+
+	switch {
+	case mode == encodingFakeGzip && encoding != "gzip" && encoding != "x-gzip":
+		return plain, "gzip", mode
+	case mode == encodingFakeBrotli && encoding != "br":
+		return plain, "br", mode
+	}
+
+	return gzipBytes(gzipBytes(plain)), "gzip", encodingDoubleGzip
+}
+
+// gzipBytes returns b gzip compressed.
+func gzipBytes(b []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	// writing to a bytes.Buffer cannot fail
+	_, _ = zw.Write(b)
+	_ = zw.Close()
+
+	return buf.Bytes()
+}
+
+const (
+	headerDropContentLength  = "drop-content-length"
+	headerBadContentType     = "bad-content-type"
+	headerDuplicateSetCookie = "duplicate-set-cookie"
+)
+
+var headerCorruptActions = []string{headerDropContentLength, headerBadContentType, headerDuplicateSetCookie}
+
+// corruptHeaders applies the header corruption actions to h, or every action
+// when actions is empty, and returns the actions that were applied.
+func corruptHeaders(h http.Header, actions []string) []string {
+	if len(actions) == 0 {
+		actions = headerCorruptActions
+	}
+
+	for _, action := range actions {
+		switch action {
+		case headerDropContentLength:
+			h.Del("Content-Length")
+		case headerBadContentType:
+			h.Set("Content-Type", "application/x-bad-proxy;;charset=")
+		case headerDuplicateSetCookie:
+			cookies := slices.Clone(h.Values("Set-Cookie"))
+			if len(cookies) == 0 {
+				cookies = []string{"bad_proxy=1", "bad_proxy=1"}
+			}
+			for _, cookie := range cookies {
+				h.Add("Set-Cookie", cookie)
+			}
+		}
+	}
+
+	return actions
+}
+
+const (
+	backendFailureTimeout     = "timeout"
+	backendFailureError       = "error"
+	backendFailureUnreachable = "unreachable"
+)
+
+// recordBackendFailure counts a real failure of the backend of a request,
+// one of the backendFailure kinds. The fault decision of the request was
+// already recorded, so the failure is counted on its own and does not enter
+// the recent window.
+func recordBackendFailure(path string, failure string) {
+	result := "backend_" + failure
+	counters.add(result, 1)
+	pathCountersFor(path).add(result, 1)
+}
+
+// addResult adds n to the count of result, one of the names returned by
+// results.
+func (s *ErrorStats) addResult(result string, n int) {
+	switch result {
+	case "success":
+		s.SuccessCount += n
+	case "disconnect":
+		s.DisconnectCount += n
+	case "reset":
+		s.ResetCount += n
+	case "tarpit":
+		s.TarpitCount += n
+	case "upload_disconnect":
+		s.UploadDisconnectCount += n
+	case "no_backend":
+		s.NoBackendCount += n
+	case "corrupt":
+		s.CorruptCount += n
+	case "header_corrupt":
+		s.HeaderCorruptCount += n
+	case "request_corrupt":
+		s.RequestCorruptCount += n
+	case "bad_encoding":
+		s.BadEncodingCount += n
+	case "bad_status_line":
+		s.BadStatusLineCount += n
+	case "partial_hang":
+		s.PartialHangCount += n
+	case "rate_limited":
+		s.RateLimitedCount += n
+	case "circuit_open":
+		s.CircuitOpenCount += n
+	case "backend_timeout":
+		s.BackendTimeoutCount += n
+	case "backend_error":
+		s.BackendErrorCount += n
+	case "backend_unreachable":
+		s.BackendUnreachableCount += n
+	case "concurrency_rejected":
+		s.ConcurrencyRejectedCount += n
+	default:
+		code, ok := statusErrorCode(result)
+		if !ok {
+			return
+		}
+
+		if s.StatusErrorCounts == nil {
+			s.StatusErrorCounts = make(map[int]int)
+		}
+		s.StatusErrorCounts[code] += n
+		switch code {
+		case http.StatusInternalServerError:
+			s.Error500Count += n
+		case http.StatusBadRequest:
+			s.Error400Count += n
+		}
+	}
+}
+
+// results returns the counts of s by result name, the error types, the
+// backend failures, "success" and "concurrency_rejected".
+func (s *ErrorStats) results() map[string]int {
+	results := map[string]int{
+		"success":              s.SuccessCount,
+		"disconnect":           s.DisconnectCount,
+		"reset":                s.ResetCount,
+		"tarpit":               s.TarpitCount,
+		"upload_disconnect":    s.UploadDisconnectCount,
+		"no_backend":           s.NoBackendCount,
+		"corrupt":              s.CorruptCount,
+		"header_corrupt":       s.HeaderCorruptCount,
+		"request_corrupt":      s.RequestCorruptCount,
+		"bad_encoding":         s.BadEncodingCount,
+		"partial_hang":         s.PartialHangCount,
+		"rate_limited":         s.RateLimitedCount,
+		"circuit_open":         s.CircuitOpenCount,
+		"bad_status_line":      s.BadStatusLineCount,
+		"backend_timeout":      s.BackendTimeoutCount,
+		"backend_error":        s.BackendErrorCount,
+		"backend_unreachable":  s.BackendUnreachableCount,
+		"concurrency_rejected": s.ConcurrencyRejectedCount,
+	}
+	for code, count := range s.StatusErrorCounts {
+		results[statusErrorType(code)] = count
+	}
+
+	return results
+}
+
+// errorRates returns the share of each error type among the recent outcomes.
+func errorRates(recent []string) map[string]float64 {
+	rates := make(map[string]float64)
+	recentCount := len(recent)
+	if recentCount == 0 {
+		return rates
+	}
+
+	counts := make(map[string]int)
+	for _, errType := range recent {
+		if errType != "" {
+			counts[errType]++
+		}
+	}
+
+	rates["disconnect"] = float64(counts["disconnect"]) / float64(recentCount)
+	rates["reset"] = float64(counts["reset"]) / float64(recentCount)
+	rates["tarpit"] = float64(counts["tarpit"]) / float64(recentCount)
+	rates["upload_disconnect"] = float64(counts["upload_disconnect"]) / float64(recentCount)
+	rates["500"] = float64(counts["error500"]) / float64(recentCount)
+	rates["400"] = float64(counts["error400"]) / float64(recentCount)
+	rates["no_backend"] = float64(counts["no_backend"]) / float64(recentCount)
+	rates["corrupt"] = float64(counts["corrupt"]) / float64(recentCount)
+	rates["header_corrupt"] = float64(counts["header_corrupt"]) / float64(recentCount)
+	rates["request_corrupt"] = float64(counts["request_corrupt"]) / float64(recentCount)
+	rates["bad_encoding"] = float64(counts["bad_encoding"]) / float64(recentCount)
+	rates["bad_status_line"] = float64(counts["bad_status_line"]) / float64(recentCount)
+	rates["partial_hang"] = float64(counts["partial_hang"]) / float64(recentCount)
+	rates["rate_limited"] = float64(counts["rate_limited"]) / float64(recentCount)
+	rates["circuit_open"] = float64(counts["circuit_open"]) / float64(recentCount)
+
+	for errType, count := range counts {
+		if code, ok := statusErrorCode(errType); ok {
+			rates[strconv.Itoa(code)] = float64(count) / float64(recentCount)
+		}
+	}
+
+	return rates
+}
+
+// totalProbability returns the sum of all fault probabilities.
+func totalProbability(weights []faultWeight) float64 {
+	total := 0.0
+	for _, w := range weights {
+		if w.prob > 0 {
+			total += w.prob
+		}
+	}
+
+	return total
+}
+
+// selectErrorType picks an error type using a single random value compared
+// against the cumulative fault probabilities, or "" for no error. When the
+// probabilities sum to more than 1 they are normalized so that every request
+// fails and each fault gets its proportional share.
+func selectErrorType(r *rand.Rand, weights []faultWeight) string {
+	randomVal := r.Float64()
+	if totalProb := totalProbability(weights); totalProb > 1 {
+		randomVal *= totalProb
+	}
+	cumulativeProb := 0.0
+
+	for _, w := range weights {
+		if w.prob <= 0 {
+			continue
+		}
+
+		cumulativeProb += w.prob
+		if randomVal < cumulativeProb {
+			return w.errorType
+		}
+	}
+
+	return ""
+}
+
+// decideErrorType selects the error type of the next request from the
+// weights, forcing an error when the policy is enabled and the window ends
+// with an unlikely streak of successiveNoErrors successes. It is shared by
+// proxyRequest and /simulate.
+func decideErrorType(r *rand.Rand, successiveNoErrors int, weights []faultWeight, force forcePolicy) string {
+	if force.enabled {
+		maxAllowedSuccessiveSuccess := calculateMaxAllowedSuccessive(totalProbability(weights),
+			force.minSuccessive, force.maxSuccessive, force.scale)
+		if force.jitterPercent > 0 && maxAllowedSuccessiveSuccess > 0 {
+			maxAllowedSuccessiveSuccess = jitterSuccessive(r, maxAllowedSuccessiveSuccess, force.jitterPercent)
+		}
+
+		if successiveNoErrors >= maxAllowedSuccessiveSuccess && maxAllowedSuccessiveSuccess > 0 {
+			if errorType := selectForcedErrorType(r, weights); errorType != "" {
+				return errorType
+			}
+		}
+	}
+
+	return selectErrorType(r, weights)
+}
+
+// faultApplies reports whether errorType can be applied to r. A request
+// without a body has nothing for request_corrupt to alter, and the response
+// to a HEAD request has no body for bad_encoding to re-encode.
+func faultApplies(errorType string, r *http.Request) bool {
+	switch errorType {
+	case "request_corrupt":
+		return r.Body != nil && r.Body != http.NoBody && r.ContentLength != 0
+	case "bad_encoding":
+		return r.Method != http.MethodHead
+	}
+
+	return true
+}
+
+// recordErrorType adds the outcome of a request at now to the window and
+// counts of st, for stats that are not shared between goroutines.
+func recordErrorType(st *ErrorStats, errorType string, now time.Time) {
+	st.recordRecent(errorType, now)
+	st.addResult(resultName(errorType), 1)
+}
+
+// jitterSuccessive returns allowed moved randomly by up to percent percent in
+// either direction, drawn from r for every request and never below 1.
+func jitterSuccessive(r *rand.Rand, allowed int, percent float64) int {
+	spread := float64(allowed) * percent / 100
+
+	return max(1, int(math.Round(float64(allowed)+(r.Float64()*2-1)*spread)))
+}
+
+// calculateMaxAllowedSuccessive returns how many successes in a row are
+// tolerated before an error is forced: scale divided by the total error
+// probability, clamped to [minSuccessive, maxSuccessive].
+func calculateMaxAllowedSuccessive(totalErrorProb float64, minSuccessive, maxSuccessive int, scale float64) int {
+	if totalErrorProb <= 0 {
+		return 0
+	}
+
+	if totalErrorProb >= 1.0 {
+		return 1
+	}
+
+	allowed := int(scale / totalErrorProb)
+	if allowed < minSuccessive {
+		return minSuccessive
+	}
+
+	if allowed > maxSuccessive {
+		return maxSuccessive
+	}
+
+	return allowed
+}
+
+func selectForcedErrorType(r *rand.Rand, weights []faultWeight) string {
+	totalProb := totalProbability(weights)
+	if totalProb <= 0 {
+		return ""
+	}
+
+	randomVal := r.Float64() * totalProb
+	cumulativeProb := 0.0
+
+	for _, w := range weights {
+		if w.prob <= 0 {
+			continue
+		}
+
+		cumulativeProb += w.prob
+		if randomVal < cumulativeProb {
+			return w.errorType
+		}
+	}
+
+	for i := len(weights) - 1; i >= 0; i-- {
+		if weights[i].prob > 0 {
+			return weights[i].errorType
+		}
+	}
+
+	return ""
+}
+
+// statusErrorMessage returns the body message of an injected status error.
+func statusErrorMessage(code int) string {
+	switch code {
+	case http.StatusInternalServerError:
+		return "Server error generated by Bad-Proxy"
+	case http.StatusBadRequest:
+		return "Bad request error generated by Bad-Proxy"
+	}
+
+	return http.StatusText(code) + " error generated by Bad-Proxy"
+}
+
+// prepareConfig validates cfg and fills in defaults.
+func prepareConfig(cfg *ProxyConfig) error {
+	if err := validateConfig(*cfg); err != nil {
+		return err
+	}
+
+	if cfg.WindowSize <= 0 {
+		cfg.WindowSize = 100
+	}
+
+	for i, method := range cfg.AllowedMethods {
+		cfg.AllowedMethods[i] = strings.ToUpper(method)
+	}
+
+	for i, route := range cfg.BackendRoutes {
+		cfg.BackendRoutes[i].Method = strings.ToUpper(route.Method)
+	}
+
+	if len(cfg.MethodOverrides) > 0 {
+		overrides := make(map[string]FaultConfig, len(cfg.MethodOverrides))
+		for method, faults := range cfg.MethodOverrides {
+			overrides[strings.ToUpper(method)] = faults
+		}
+		cfg.MethodOverrides = overrides
+	}
+
+	for i, rule := range cfg.PathRewrites {
+		if !rule.Regex {
+			continue
+		}
+
+		re, err := regexp.Compile(rule.From)
+		if err != nil {
+			return fmt.Errorf("invalid path_rewrites regex %q: %w", rule.From, err)
+		}
+		cfg.PathRewrites[i].re = re
+	}
+
+	return nil
+}
+
+// applyConfig replaces the live configuration with a prepared newConfig.
+// source names where the configuration came from for the log line.
+func applyConfig(newConfig ProxyConfig, logger *zap.Logger, source string) {
+	_, _ = updateConfig(func(ProxyConfig) (ProxyConfig, error) {
+		return newConfig, nil
+	}, logger, source)
+}
+
+// updateConfig replaces the live configuration with the prepared one that
+// update derives from it, holding the configuration lock throughout so that
+// concurrent updates cannot overwrite each other. When update fails the live
+// configuration is kept and its error returned.
+func updateConfig(update func(ProxyConfig) (ProxyConfig, error), logger *zap.Logger, source string) (ProxyConfig, error) {
+	configMutex.Lock()
+	oldWindowSize, oldWindowDuration := config.WindowSize, config.windowDuration()
+	newConfig, err := update(config)
+	if err != nil {
+		configMutex.Unlock()
+		return ProxyConfig{}, err
+	}
+	config = newConfig
+	configMutex.Unlock()
+
+	if oldWindowSize != newConfig.WindowSize || oldWindowDuration != newConfig.windowDuration() {
+		statsMutex.Lock()
+		stats.resizeRecent(newConfig.WindowSize, newConfig.windowDuration())
+		statsMutex.Unlock()
+	}
+
+	logger.Info("Proxy configuration updated",
+		zap.String("source", source),
+		zap.String("profile", newConfig.profile),
+		zap.Bool("globally_disabled", newConfig.GloballyDisabled),
+		zap.Int("latency", newConfig.Latency),
+		zap.Int("connect_latency", newConfig.ConnectLatency),
+		zap.Int("latency_ms", newConfig.LatencyMs),
+		zap.Int("connect_latency_ms", newConfig.ConnectLatencyMs),
+		zap.Int("latency_min_ms", newConfig.LatencyMinMs),
+		zap.Int("latency_max_ms", newConfig.LatencyMaxMs),
+		zap.String("latency_distribution", newConfig.latencyDistribution()),
+		zap.Float64("latency_mean_ms", newConfig.LatencyMeanMs),
+		zap.Float64("latency_stddev_ms", newConfig.LatencyStddevMs),
+		zap.Float64("latency_per_kb_ms", newConfig.LatencyPerKBMs),
+		zap.Int("header_latency_ms", newConfig.HeaderLatencyMs),
+		zap.Intp("error_latency_ms", newConfig.ErrorLatencyMs),
+		zap.Float64("no_backend", newConfig.NoBackend),
+		zap.Float64("500", newConfig.Error500),
+		zap.Float64("400", newConfig.Error400),
+		zap.Any("status_errors", newConfig.StatusErrors),
+		zap.Float64("disconnect", newConfig.Disconnect),
+		zap.Float64("reset", newConfig.Reset),
+		zap.Float64("tarpit", newConfig.Tarpit),
+		zap.Float64("upload_disconnect", newConfig.UploadDisconnect),
+		zap.Float64("corrupt", newConfig.Corrupt),
+		zap.Float64("header_corrupt", newConfig.HeaderCorrupt),
+		zap.Float64("request_corrupt", newConfig.RequestCorrupt),
+		zap.String("request_corrupt_mode", cmp.Or(newConfig.RequestCorruptMode, corruptTruncate)),
+		zap.Float64("bad_encoding", newConfig.BadEncoding),
+		zap.Strings("bad_encoding_modes", newConfig.BadEncodingModes),
+		zap.Float64("bad_status_line", newConfig.BadStatusLine),
+		zap.Float64("partial_hang", newConfig.PartialHang),
+		zap.Int("max_kbps", newConfig.MaxKBps),
+		zap.Bool("burst_mode", newConfig.BurstMode),
+		zap.Int("window_size", newConfig.WindowSize),
+		zap.String("window_mode", cmp.Or(newConfig.WindowMode, windowModeCount)),
+		zap.Int("window_seconds", newConfig.WindowSeconds),
+		zap.Strings("allowed_methods", newConfig.AllowedMethods),
+		zap.Int("routes", len(newConfig.Routes)),
+		zap.Int("method_overrides", len(newConfig.MethodOverrides)),
+		zap.Int("mock_responses", len(newConfig.MockResponses)),
+		zap.Int("backend_routes", len(newConfig.BackendRoutes)),
+		zap.Any("match_headers", newConfig.MatchHeaders),
+		zap.Any("match_query", newConfig.MatchQuery),
+		zap.Int64("max_body_bytes", newConfig.MaxBodyBytes),
+		zap.Int("read_timeout", newConfig.ReadTimeout),
+		zap.Int("write_timeout", newConfig.WriteTimeout),
+		zap.Int("rate_limit_per_min", newConfig.RateLimitPerMin),
+		zap.Int("max_concurrency", newConfig.MaxConcurrency),
+		zap.Int("circuit_threshold", newConfig.CircuitThreshold),
+		zap.Bool("allow_header_override", newConfig.AllowHeaderOverride),
+	)
+
+	return newConfig, nil
+}
+
+// loadConfigFile reads and prepares a configuration file with the same JSON
+// shape as the POST /config body.
+func loadConfigFile(configPath string) (ProxyConfig, error) {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return ProxyConfig{}, err
+	}
+
+	var fileConfig ProxyConfig
+	if err := json.Unmarshal(data, &fileConfig); err != nil {
+		return ProxyConfig{}, fmt.Errorf("invalid configuration format: %w", err)
+	}
+
+	if err := prepareConfig(&fileConfig); err != nil {
+		return ProxyConfig{}, err
+	}
+
+	return fileConfig, nil
+}
+
+var (
+	// profiles holds named configurations that can be activated through
+	// the API. They are saved to profilesFile when it is set.
+	profiles      = map[string]ProxyConfig{}
+	profilesMutex sync.Mutex
+	profilesFile  string
+)
+
+// profilesPath returns the file profiles are saved to next to configPath,
+// e.g. config.profiles.json for config.json.
+func profilesPath(configPath string) string {
+	return strings.TrimSuffix(configPath, filepath.Ext(configPath)) + ".profiles.json"
+}
+
+// loadProfiles reads the profiles saved in file. A missing file yields no
+// profiles.
+func loadProfiles(file string) (map[string]ProxyConfig, error) {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string]ProxyConfig{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var loaded map[string]ProxyConfig
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return nil, fmt.Errorf("invalid profiles format: %w", err)
+	}
+
+	for name, profile := range loaded {
+		if err := prepareConfig(&profile); err != nil {
+			return nil, fmt.Errorf("profile %q: %w", name, err)
+		}
+		loaded[name] = profile
+	}
+
+	return loaded, nil
+}
+
+// saveProfiles writes the profiles to profilesFile, if set, replacing the
+// file atomically. It must be called with profilesMutex held.
+func saveProfiles() error {
+	if profilesFile == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(profiles, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := profilesFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, profilesFile)
+}
+
+// storeProfile adds or replaces the prepared profile name. The profile is
+// kept in memory even when saving it fails.
+func storeProfile(name string, profile ProxyConfig) error {
+	profilesMutex.Lock()
+	defer profilesMutex.Unlock()
+
+	profiles[name] = profile
+
+	return saveProfiles()
+}
+
+// deleteProfile removes the profile name and reports whether it existed.
+// The active configuration is not changed.
+func deleteProfile(name string) (bool, error) {
+	profilesMutex.Lock()
+	defer profilesMutex.Unlock()
+
+	if _, ok := profiles[name]; !ok {
+		return false, nil
+	}
+	delete(profiles, name)
+
+	return true, saveProfiles()
+}
+
+// watchConfigFile reloads configPath whenever it changes. The parent
+// directory is watched so that editors replacing the file are noticed.
+// Invalid files are logged and the previous configuration is kept.
+func watchConfigFile(configPath string, logger *zap.Logger) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logger.Error("Unable to watch configuration file", zap.String("config_file", configPath), zap.Error(err))
+		return
+	}
+	defer func() {
+		_ = watcher.Close()
+	}()
+
+	if err := watcher.Add(filepath.Dir(configPath)); err != nil {
+		logger.Error("Unable to watch configuration file", zap.String("config_file", configPath), zap.Error(err))
+		return
+	}
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+
+			if filepath.Clean(event.Name) != filepath.Clean(configPath) ||
+				!event.Has(fsnotify.Write) && !event.Has(fsnotify.Create) {
+				continue
+			}
+
+			fileConfig, err := loadConfigFile(configPath)
+			if err != nil {
+				logger.Warn("Ignoring invalid configuration file, keeping previous configuration",
+					zap.String("config_file", configPath), zap.Error(err))
+				continue
+			}
+
+			applyConfig(fileConfig, logger, "file")
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			logger.Warn("Configuration file watcher error", zap.Error(err))
+		}
+	}
+}
+
+const maxSimulatedRequests = 1000000
+
+// SimulationRequest asks /simulate to run the fault selection of Config
+// Requests times for a request to Path with a generator seeded from Seed.
+type SimulationRequest struct {
+	Config   ProxyConfig `json:"config"`
+	Requests int         `json:"requests"`
+	Seed     uint64      `json:"seed"`
+	Path     string      `json:"path"`
+	Method   string      `json:"method"`
+}
+
+// SimulationResult is the distribution of outcomes of a simulation. Counts
+// and Rates are keyed by error type with "success" for clean requests, and
+// Expected holds the configured share of each error type.
+type SimulationResult struct {
+	Requests      int                `json:"requests"`
+	Seed          uint64             `json:"seed"`
+	Counts        map[string]int     `json:"counts"`
+	Rates         map[string]float64 `json:"rates"`
+	Expected      map[string]float64 `json:"expected"`
+	LongestStreak int                `json:"longest_success_streak"`
+}
+
+// simulate runs the same selection as proxyRequest against a private
+// generator and statistics, so live traffic and stats are not affected.
+// Rate limiting depends on clients and time and is not simulated.
+func simulate(simRequest SimulationRequest) SimulationResult {
+	r := rand.New(rand.NewPCG(simRequest.Seed, simRequest.Seed))
+	// simulated requests have no arrival times, so the window always counts
+	// requests
+	simStats := newErrorStats(simRequest.Config.WindowSize, 0)
+	weights := simRequest.Config.faultsFor(strings.ToUpper(cmp.Or(simRequest.Method, http.MethodGet)), simRequest.Path).faultWeights()
+	force := simRequest.Config.forcePolicy()
+	burst := simRequest.Config.burstPolicy()
+
+	result := SimulationResult{
+		Requests: simRequest.Requests,
+		Seed:     simRequest.Seed,
+		Counts:   make(map[string]int),
+		Rates:    make(map[string]float64),
+		Expected: make(map[string]float64),
 	}
-	statsMutex sync.RWMutex
-)
 
-func main() {
-	readTimeoutInt, err := strconv.Atoi(readTimeout)
-	if err != nil {
-		fmt.Println("Parsing error, READ_TIMEOUT must be an integer of seconds.")
-		os.Exit(1)
-	}
+	streak := 0
+	for range simRequest.Requests {
+		simStats.Total++
+		now := time.Now()
+		errorType := decideErrorType(r, simStats.successiveNoErrors(now), burst.weights(weights, simStats.BurstRemaining > 0), force)
+		recordErrorType(&simStats, errorType, now)
+		recordBurst(&simStats, errorType, burst)
 
-	writeTimeoutInt, err := strconv.Atoi(writeTimeout)
-	if err != nil {
-		fmt.Println("Parsing error, WRITE_TIMEOUT must be an integer of seconds.")
-		os.Exit(1)
-	}
+		if errorType == "" {
+			result.Counts["success"]++
+			streak++
+			result.LongestStreak = max(result.LongestStreak, streak)
+			continue
+		}
 
-	readTimeoutCfgInt, err := strconv.Atoi(readTimeoutCfg)
-	if err != nil {
-		fmt.Println("Parsing error, READ_TIMEOUT_CFG must be an integer of seconds.")
-		os.Exit(1)
+		result.Counts[errorType]++
+		streak = 0
 	}
 
-	writeTimeoutCfgInt, err := strconv.Atoi(writeTimeoutCfg)
-	if err != nil {
-		fmt.Println("Parsing error, WRITE_TIMEOUT_CFG must be an integer of seconds.")
-		os.Exit(1)
+	for errorType, count := range result.Counts {
+		result.Rates[errorType] = float64(count) / float64(simRequest.Requests)
 	}
 
-	zapCfg := zap.NewProductionConfig()
-	baseLogger, err := zapCfg.Build()
-	if err != nil {
-		fmt.Printf("Can not build logger: %s\n", err.Error())
-		os.Exit(1)
+	totalProb := totalProbability(weights)
+	for _, w := range weights {
+		if w.prob > 0 {
+			result.Expected[w.errorType] = w.prob / max(1, totalProb)
+		}
 	}
+	result.Expected["success"] = max(0, 1-totalProb)
 
-	logger := baseLogger.With(zap.String("app", Service), zap.String("app_version", Version))
-	logger.Info("Starting Bad Proxy Server",
-		zap.String("port", port),
-		zap.String("ip", ip),
-		zap.String("backend_url", backendURL),
-	)
-
-	r := gin.New()
-	r.Use(ginzap.Ginzap(logger, time.RFC3339, true))
+	return result
+}
 
-	r.Any("/*path", func(c *gin.Context) {
-		proxyRequest(c, logger)
-	})
+// ScheduleStep applies Config for Duration seconds.
+type ScheduleStep struct {
+	Duration int         `json:"duration"`
+	Config   ProxyConfig `json:"config"`
+}
 
-	rCfg := gin.New()
-	rCfg.Use(ginzap.Ginzap(logger, time.RFC3339, true))
+// Schedule is a sequence of configurations applied one after the other,
+// starting over from the first step when Loop is set.
+type Schedule struct {
+	Steps []ScheduleStep `json:"steps"`
+	Loop  bool           `json:"loop"`
+}
 
-	rCfg.GET("/status", func(c *gin.Context) {
-		c.JSON(http.StatusOK, gin.H{
-			"status":      "ok",
-			"version":     Version,
-			"port":        port,
-			"ip":          ip,
-			"backend_url": backendURL,
-		})
-	})
+// ScheduleStatus reports the running schedule and its active step.
+type ScheduleStatus struct {
+	Active   bool      `json:"active"`
+	Schedule *Schedule `json:"schedule,omitempty"`
+	Step     int       `json:"step"`
+	StepEnds time.Time `json:"step_ends,omitzero"`
+}
 
-	rCfg.GET("/config", func(c *gin.Context) {
-		configMutex.RLock()
-		currentConfig := config
-		configMutex.RUnlock()
+var (
+	// scheduleStatus and scheduleCancel describe the running schedule and
+	// are guarded by scheduleMutex.
+	scheduleStatus ScheduleStatus
+	scheduleCancel context.CancelFunc
+	scheduleMutex  sync.Mutex
+)
 
-		statsMutex.RLock()
-		currentStats := stats
-		statsMutex.RUnlock()
+// prepareSchedule validates every step of sched and fills in the
+// configuration defaults.
+func prepareSchedule(sched *Schedule) error {
+	if len(sched.Steps) == 0 {
+		return errors.New("schedule must contain at least one step")
+	}
 
-		c.JSON(http.StatusOK, gin.H{
-			"config": currentConfig,
-			"stats":  currentStats,
-		})
-	})
+	for i := range sched.Steps {
+		if sched.Steps[i].Duration <= 0 {
+			return fmt.Errorf("steps[%d]: duration must be a positive number of seconds", i)
+		}
 
-	rCfg.GET("/reset-stats", func(c *gin.Context) {
-		statsMutex.Lock()
-		stats = ErrorStats{
-			RecentErrors: make([]string, config.WindowSize),
-			CurrentRates: make(map[string]float64),
+		if err := prepareConfig(&sched.Steps[i].Config); err != nil {
+			return fmt.Errorf("steps[%d]: %w", i, err)
 		}
-		statsMutex.Unlock()
+	}
 
-		c.JSON(http.StatusOK, gin.H{
-			"status": "Statistics reset successful",
-		})
-	})
+	return nil
+}
 
-	rCfg.POST("/config", func(c *gin.Context) {
-		var newConfig ProxyConfig
-		if err := c.ShouldBindJSON(&newConfig); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid configuration format"})
-			return
-		}
+// startSchedule replaces any running schedule with sched.
+func startSchedule(sched Schedule, logger *zap.Logger) {
+	ctx, cancel := context.WithCancel(context.Background())
 
-		if newConfig.WindowSize <= 0 {
-			newConfig.WindowSize = 100
-		}
+	scheduleMutex.Lock()
+	if scheduleCancel != nil {
+		scheduleCancel()
+	}
+	scheduleCancel = cancel
+	scheduleStatus = ScheduleStatus{Active: true, Schedule: &sched}
+	scheduleMutex.Unlock()
 
-		oldWindowSize := config.WindowSize
+	go runSchedule(ctx, sched, logger)
+}
 
-		configMutex.Lock()
-		config = newConfig
-		configMutex.Unlock()
+// stopSchedule stops the running schedule, leaving the configuration of its
+// active step in place.
+func stopSchedule() {
+	scheduleMutex.Lock()
+	defer scheduleMutex.Unlock()
 
-		if oldWindowSize != newConfig.WindowSize {
-			statsMutex.Lock()
-			stats.RecentErrors = make([]string, newConfig.WindowSize)
-			statsMutex.Unlock()
-		}
-
-		logger.Info("Proxy configuration updated",
-			zap.Int("latency", newConfig.Latency),
-			zap.Int("connect_latency", newConfig.ConnectLatency),
-			zap.Float64("no_backend", newConfig.NoBackend),
-			zap.Float64("500", newConfig.Error500),
-			zap.Float64("400", newConfig.Error400),
-			zap.Float64("disconnect", newConfig.Disconnect),
-			zap.Float64("corrupt", newConfig.Corrupt),
-			zap.Int("window_size", newConfig.WindowSize),
-		)
+	if scheduleCancel != nil {
+		scheduleCancel()
+		scheduleCancel = nil
+	}
+	scheduleStatus = ScheduleStatus{}
+}
 
-		c.JSON(http.StatusOK, gin.H{"status": "configuration updated"})
-	})
+func currentScheduleStatus() ScheduleStatus {
+	scheduleMutex.Lock()
+	defer scheduleMutex.Unlock()
 
-	go func() {
-		logger.Info("Starting Bad Proxy Configuration Server",
-			zap.String("version", Version),
-			zap.String("port", portCfg),
-		)
+	return scheduleStatus
+}
 
-		sCfg := &http.Server{
-			Addr:           ip + ":" + portCfg,
-			Handler:        rCfg,
-			ReadTimeout:    time.Duration(readTimeoutCfgInt) * time.Second,
-			WriteTimeout:   time.Duration(writeTimeoutCfgInt) * time.Second,
-			MaxHeaderBytes: 1 << 20,
-		}
+// runSchedule applies each step of sched in turn until the schedule ends or
+// ctx is cancelled.
+func runSchedule(ctx context.Context, sched Schedule, logger *zap.Logger) {
+	for {
+		for i, step := range sched.Steps {
+			stepDuration := time.Duration(step.Duration) * time.Second
 
-		err = sCfg.ListenAndServe()
-		if err != nil {
-			logger.Fatal("unable to start the Bad Proxy Configuration Server", zap.Error(err))
+			scheduleMutex.Lock()
+			if ctx.Err() != nil {
+				scheduleMutex.Unlock()
+				return
+			}
+			scheduleStatus.Step = i
+			scheduleStatus.StepEnds = time.Now().Add(stepDuration)
+
+			// applied under scheduleMutex so a concurrent stop cannot be
+			// overridden by a step that was about to start
+			logger.Info("Applying schedule step", zap.Int("step", i), zap.Int("duration_seconds", step.Duration))
+			applyConfig(step.Config, logger, "schedule")
+			scheduleMutex.Unlock()
+
+			timer := time.NewTimer(stepDuration)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
 		}
-	}()
 
-	s := &http.Server{
-		Addr:           ip + ":" + port,
-		Handler:        r,
-		ReadTimeout:    time.Duration(readTimeoutInt) * time.Second,
-		WriteTimeout:   time.Duration(writeTimeoutInt) * time.Second,
-		MaxHeaderBytes: 1 << 20,
+		if !sched.Loop {
+			break
+		}
 	}
 
-	err = s.ListenAndServe()
-	if err != nil {
-		logger.Fatal(err.Error())
+	scheduleMutex.Lock()
+	if ctx.Err() == nil {
+		scheduleCancel()
+		scheduleStatus = ScheduleStatus{}
+		scheduleCancel = nil
 	}
+	scheduleMutex.Unlock()
+
+	logger.Info("Schedule finished")
 }
 
-func proxyRequest(c *gin.Context, logger *zap.Logger) {
-	if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodPost {
-		c.JSON(http.StatusMethodNotAllowed, gin.H{"error": "Only GET and POST methods are supported"})
-		return
+func validateConfig(cfg ProxyConfig) error {
+	// the ranges of single fields come from their jsonschema tags, every
+	// offending field is reported at once
+	if violations := rangeViolations(reflect.ValueOf(cfg), ""); len(violations) > 0 {
+		return errors.New("invalid configuration: " + strings.Join(violations, "; "))
 	}
 
-	configMutex.RLock()
-	latency := config.Latency
-	connectLatency := config.ConnectLatency
-	noBackendProb := config.NoBackend
-	error500Prob := config.Error500
-	error400Prob := config.Error400
-	disconnectProb := config.Disconnect
-	corruptProb := config.Corrupt
-	forceErrors := config.ForceErrors
-	windowSize := config.WindowSize
-	configMutex.RUnlock()
+	if force := cfg.forcePolicy(); force.minSuccessive > force.maxSuccessive {
+		return errors.New("force_min_successive must not be greater than force_max_successive")
+	}
 
-	statsMutex.Lock()
-	stats.Total++
-	recentPos := stats.Total % windowSize
-	if recentPos >= len(stats.RecentErrors) {
-		recentPos = len(stats.RecentErrors) - 1
+	switch cfg.WindowMode {
+	case "", windowModeCount, windowModeTime:
+	default:
+		return fmt.Errorf("unknown error_window_mode %q", cfg.WindowMode)
 	}
 
-	var errorType string
-	applyError := false
+	switch cfg.OnSaturated {
+	case "", onSaturatedReject, onSaturatedQueue:
+	default:
+		return fmt.Errorf("unknown on_saturated %q", cfg.OnSaturated)
+	}
 
-	if forceErrors {
-		successiveNoErrors := countSuccessiveNoErrors(stats.RecentErrors)
-		maxAllowedSuccessiveSuccess := calculateMaxAllowedSuccessive(disconnectProb, error500Prob, error400Prob, noBackendProb, corruptProb)
+	if err := validateFaults(cfg.FaultConfig); err != nil {
+		return err
+	}
 
-		if successiveNoErrors >= maxAllowedSuccessiveSuccess && maxAllowedSuccessiveSuccess > 0 {
-			applyError = true
-			errorType = selectForcedErrorType(disconnectProb, error500Prob, error400Prob, noBackendProb, corruptProb)
+	for name := range cfg.MatchHeaders {
+		if name == "" {
+			return errors.New("match_headers names must not be empty")
 		}
 	}
 
-	if !applyError {
-		randomVal := rand.Float64()
-		cumulativeProb := 0.0
-
-		if disconnectProb > 0 {
-			cumulativeProb += disconnectProb
-			if randomVal < cumulativeProb {
-				errorType = "disconnect"
-				applyError = true
-			}
+	for name := range cfg.MatchQuery {
+		if name == "" {
+			return errors.New("match_query names must not be empty")
 		}
+	}
 
-		if !applyError && error500Prob > 0 {
-			cumulativeProb += error500Prob
-			if randomVal < cumulativeProb {
-				errorType = "error500"
-				applyError = true
-			}
+	for _, rule := range cfg.PathRewrites {
+		if rule.From == "" {
+			return errors.New("path_rewrites from must not be empty")
 		}
+	}
 
-		if !applyError && error400Prob > 0 {
-			cumulativeProb += error400Prob
-			if randomVal < cumulativeProb {
-				errorType = "error400"
-				applyError = true
-			}
+	for _, mock := range cfg.MockResponses {
+		if mock.Path == "" {
+			return errors.New("mock_responses path must not be empty")
 		}
 
-		if !applyError && noBackendProb > 0 {
-			cumulativeProb += noBackendProb
-			if randomVal < cumulativeProb {
-				errorType = "no_backend"
-				applyError = true
-			}
+		if _, err := path.Match(mock.Path, ""); err != nil {
+			return fmt.Errorf("invalid mock_responses path %q: %w", mock.Path, err)
 		}
 
-		if !applyError && corruptProb > 0 {
-			cumulativeProb += corruptProb
-			if randomVal < cumulativeProb {
-				errorType = "corrupt"
-				applyError = true
-			}
+		if mock.Status != 0 && (mock.Status < 100 || mock.Status > 599) {
+			return fmt.Errorf("mock_responses status %d is not a valid HTTP status code", mock.Status)
 		}
 	}
 
-	stats.RecentErrors[recentPos] = errorType
-	updateErrorStats(errorType, &stats)
-	updateErrorRates(&stats, windowSize)
-	statsMutex.Unlock()
+	for _, route := range cfg.BackendRoutes {
+		if route.Method != "" && !httpguts.ValidHeaderFieldName(route.Method) {
+			return fmt.Errorf("backend_routes method %q is not a valid HTTP method", route.Method)
+		}
 
-	if connectLatency > 0 {
-		time.Sleep(time.Duration(connectLatency) * time.Second)
+		if u, err := url.Parse(route.URL); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("backend_routes url %q must be an absolute URL", route.URL)
+		}
 	}
 
-	if errorType == "disconnect" {
-		logger.Info("Disconnecting based on configured probability",
-			zap.Int("request_num", stats.Total),
-			zap.Float64("disconnect", disconnectProb))
-
-		hijacker, ok := c.Writer.(http.Hijacker)
-		if !ok {
-			logger.Error("Response writer does not support hijacking")
-			c.AbortWithStatus(http.StatusInternalServerError)
-			return
+	methods := make(map[string]bool, len(cfg.MethodOverrides))
+	for method, faults := range cfg.MethodOverrides {
+		if !httpguts.ValidHeaderFieldName(method) {
+			return fmt.Errorf("method_overrides key %q is not a valid HTTP method", method)
 		}
 
-		conn, _, err := hijacker.Hijack()
-		if err != nil {
-			logger.Error("Failed to hijack connection", zap.Error(err))
-			c.AbortWithStatus(http.StatusInternalServerError)
-			return
+		upper := strings.ToUpper(method)
+		if methods[upper] {
+			return fmt.Errorf("method_overrides has more than one entry for %s", upper)
 		}
+		methods[upper] = true
 
-		err = conn.Close()
-		if err != nil {
-			return
+		if err := validateFaults(faults); err != nil {
+			return fmt.Errorf("method_overrides %s: %w", upper, err)
 		}
-		c.Abort()
-		return
 	}
 
-	if errorType == "no_backend" {
-		logger.Info("Preventing backend request based on configured probability",
-			zap.Int("request_num", stats.Total),
-			zap.Float64("no_backend", noBackendProb))
-
-		time.Sleep(time.Duration(latency) * time.Second)
-		c.JSON(http.StatusOK, gin.H{"message": "Response generated by Bad-Proxy without reaching backend"})
-		return
-	}
+	for _, route := range cfg.Routes {
+		if route.Path == "" {
+			return errors.New("route path must not be empty")
+		}
 
-	if errorType == "error400" {
-		logger.Info("Returning 400 Bad Request based on configured probability",
-			zap.Int("request_num", stats.Total),
-			zap.Float64("error400", error400Prob))
+		if _, err := path.Match(route.Path, ""); err != nil {
+			return fmt.Errorf("invalid route path %q: %w", route.Path, err)
+		}
 
-		time.Sleep(time.Duration(latency) * time.Second)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Bad request error generated by Bad-Proxy"})
-		return
+		if err := validateFaults(route.FaultConfig); err != nil {
+			return fmt.Errorf("route %q: %w", route.Path, err)
+		}
 	}
 
-	if errorType == "error500" {
-		logger.Info("Returning 500 Internal Server Error based on configured probability",
-			zap.Int("request_num", stats.Total),
-			zap.Float64("error500", error500Prob))
+	return nil
+}
 
-		time.Sleep(time.Duration(latency) * time.Second)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error generated by Bad-Proxy"})
-		return
+func validateFaults(cfg FaultConfig) error {
+	for code := range cfg.StatusErrors {
+		if code < 200 || code > 599 {
+			return fmt.Errorf("status_errors code %d is not a valid HTTP status code", code)
+		}
 	}
 
-	if latency > 0 && connectLatency == 0 {
-		time.Sleep(time.Duration(latency) * time.Second)
+	for _, code := range cfg.CorruptOnlyStatus {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("corrupt_only_status code %d is not a valid HTTP status code", code)
+		}
 	}
 
-	targetURL := backendURL + c.Request.URL.Path
-	if c.Request.URL.RawQuery != "" {
-		targetURL += "?" + c.Request.URL.RawQuery
+	switch cfg.CorruptMode {
+	case "", corruptTruncate, corruptBitflip, corruptShuffle, corruptCompressed, corruptInflate:
+	default:
+		return fmt.Errorf("unknown corrupt_mode %q", cfg.CorruptMode)
 	}
 
-	var requestBody []byte
-	if c.Request.Body != nil {
-		var err error
-		requestBody, err = io.ReadAll(c.Request.Body)
-		if err != nil {
-			logger.Error("Failed to read request body", zap.Error(err))
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read request body"})
-			return
-		}
+	switch cfg.RequestCorruptMode {
+	case "", corruptTruncate, corruptBitflip, corruptShuffle:
+	default:
+		return fmt.Errorf("unknown request_corrupt_mode %q", cfg.RequestCorruptMode)
 	}
 
-	req, err := http.NewRequest(c.Request.Method, targetURL, bytes.NewBuffer(requestBody))
-	if err != nil {
-		logger.Error("Failed to create proxy request", zap.Error(err))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create proxy request"})
-		return
+	if minFraction, maxFraction := cfg.corruptFractions(); minFraction >= maxFraction {
+		return errors.New("corrupt_min_fraction must be less than corrupt_max_fraction")
 	}
 
-	for name, values := range c.Request.Header {
-		for _, value := range values {
-			req.Header.Add(name, value)
+	for _, mode := range cfg.BadStatusLineModes {
+		if !slices.Contains(badStatusLineModes, mode) {
+			return fmt.Errorf("unknown bad_status_line_modes entry %q", mode)
 		}
 	}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		logger.Error("Failed to execute proxy request", zap.Error(err))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to execute proxy request"})
-		return
-	}
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
-		if err != nil {
-			logger.Error("Failed to close response body", zap.Error(err))
+	for _, mode := range cfg.BadEncodingModes {
+		if !slices.Contains(badEncodingModes, mode) {
+			return fmt.Errorf("unknown bad_encoding_modes entry %q", mode)
 		}
-	}(resp.Body)
+	}
 
-	for name, values := range resp.Header {
-		for _, value := range values {
-			c.Header(name, value)
+	for _, action := range cfg.HeaderCorruptActions {
+		if !slices.Contains(headerCorruptActions, action) {
+			return fmt.Errorf("unknown header_corrupt_actions entry %q", action)
 		}
 	}
 
-	c.Status(resp.StatusCode)
-
-	if errorType == "corrupt" {
-		logger.Info("Corrupting response based on configured probability",
-			zap.Int("request_num", stats.Total),
-			zap.Float64("corrupt", corruptProb))
-
-		responseBody, err := io.ReadAll(resp.Body)
-		if err != nil {
-			logger.Error("Failed to read response body for corruption", zap.Error(err))
-			c.Status(http.StatusInternalServerError)
-			return
+	for name, value := range cfg.InjectHeaders {
+		if !httpguts.ValidHeaderFieldName(name) || !httpguts.ValidHeaderFieldValue(value) {
+			return fmt.Errorf("inject_headers entry %q is not a valid header", name)
 		}
+	}
 
-		originalLength := len(responseBody)
-		if originalLength > 0 {
-			minLength := int(float64(originalLength) * 0.1)
-			maxLength := int(float64(originalLength) * 0.9)
-
-			if minLength < 1 {
-				minLength = 1
-			}
-
-			if maxLength <= minLength {
-				maxLength = minLength + 1
-			}
-
-			truncatedLength := minLength
-			if maxLength > minLength {
-				truncatedLength = minLength + rand.IntN(maxLength-minLength)
-			}
-
-			logger.Info("Truncating response",
-				zap.Int("original_length", originalLength),
-				zap.Int("truncated_length", truncatedLength))
+	if cfg.LatencyMinMs > cfg.LatencyMaxMs && cfg.LatencyMaxMs > 0 {
+		return errors.New("latency_min_ms must not be greater than latency_max_ms")
+	}
 
-			_, err = c.Writer.Write(responseBody[:truncatedLength])
-			if err != nil {
-				logger.Error("Failed to write corrupted response", zap.Error(err))
-			}
-		}
-	} else {
-		_, err = io.Copy(c.Writer, resp.Body)
-		if err != nil {
-			logger.Error("Failed to copy response body", zap.Error(err))
+	switch cfg.LatencyDistribution {
+	case "", latencyFixed, latencyNormal, latencyExponential:
+	case latencyUniform:
+		if cfg.LatencyMinMs > cfg.LatencyMaxMs {
+			return errors.New("latency_distribution uniform needs latency_max_ms of at least latency_min_ms")
 		}
+	default:
+		return fmt.Errorf("unknown latency_distribution %q", cfg.LatencyDistribution)
 	}
-}
 
-func updateErrorStats(errorType string, stats *ErrorStats) {
-	switch errorType {
-	case "disconnect":
-		stats.DisconnectCount++
-	case "error500":
-		stats.Error500Count++
-	case "error400":
-		stats.Error400Count++
-	case "no_backend":
-		stats.NoBackendCount++
-	case "corrupt":
-		stats.CorruptCount++
-	case "":
-		stats.SuccessCount++
-	}
+	return nil
 }
 
-func updateErrorRates(stats *ErrorStats, windowSize int) {
-	recentCount := stats.Total
-	if recentCount > windowSize {
-		recentCount = windowSize
+func getEnv(key, fallback string) string {
+	value := os.Getenv(key)
+	if len(value) == 0 {
+		return fallback
 	}
 
-	stats.RecentTotal = recentCount
+	return value
+}
 
-	if recentCount == 0 {
-		return
-	}
+// configSchema is the JSON Schema of the POST /config body. It is built once
+// from the json and jsonschema struct tags of ProxyConfig so that it follows
+// the configuration as fields are added.
+var configSchema = sync.OnceValue(func() map[string]any {
+	schema := jsonSchema(reflect.TypeFor[ProxyConfig]())
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["title"] = "bad-proxy configuration"
 
-	disconnectCount := 0
-	error500Count := 0
-	error400Count := 0
-	noBackendCount := 0
-	corruptCount := 0
+	return schema
+})
 
-	for _, errType := range stats.RecentErrors {
-		switch errType {
-		case "disconnect":
-			disconnectCount++
-		case "error500":
-			error500Count++
-		case "error400":
-			error400Count++
-		case "no_backend":
-			noBackendCount++
-		case "corrupt":
-			corruptCount++
+// jsonSchema returns the JSON Schema of values of type t. Struct fields are
+// named by their json tag, and embedded structs are flattened like
+// encoding/json does.
+func jsonSchema(t reflect.Type) map[string]any {
+	switch t.Kind() {
+	case reflect.Pointer:
+		schema := jsonSchema(t.Elem())
+		schema["type"] = []any{schema["type"], "null"}
+		return schema
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": jsonSchema(t.Elem())}
+	case reflect.Map:
+		schema := map[string]any{"type": "object", "additionalProperties": jsonSchema(t.Elem())}
+		if t.Key().Kind() != reflect.String {
+			// integer keys such as status codes are written as strings
+			schema["propertyNames"] = map[string]any{"pattern": "^[0-9]+$"}
 		}
+		return schema
+	case reflect.Struct:
+		properties := map[string]any{}
+		addSchemaProperties(t, properties)
+		return map[string]any{"type": "object", "properties": properties, "additionalProperties": false}
 	}
 
-	stats.CurrentRates["disconnect"] = float64(disconnectCount) / float64(recentCount)
-	stats.CurrentRates["500"] = float64(error500Count) / float64(recentCount)
-	stats.CurrentRates["400"] = float64(error400Count) / float64(recentCount)
-	stats.CurrentRates["no_backend"] = float64(noBackendCount) / float64(recentCount)
-	stats.CurrentRates["corrupt"] = float64(corruptCount) / float64(recentCount)
+	return map[string]any{"type": "string"}
 }
 
-func countSuccessiveNoErrors(recentErrors []string) int {
-	count := 0
-	for i := len(recentErrors) - 1; i >= 0; i-- {
-		if recentErrors[i] == "" {
-			count++
-		} else if recentErrors[i] != "" {
-			break
+// addSchemaProperties adds the schema of every exported field of the struct
+// type t to properties.
+func addSchemaProperties(t reflect.Type, properties map[string]any) {
+	for i := range t.NumField() {
+		field := t.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			addSchemaProperties(field.Type, properties)
+			continue
 		}
+
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if !field.IsExported() || name == "" || name == "-" {
+			continue
+		}
+
+		schema := jsonSchema(field.Type)
+		applySchemaTag(schema, field.Tag.Get("jsonschema"))
+		properties[name] = schema
 	}
-	return count
 }
 
-func calculateMaxAllowedSuccessive(disconnectProb, error500Prob, error400Prob, noBackendProb, corruptProb float64) int {
-	totalErrorProb := disconnectProb + error500Prob + error400Prob + noBackendProb + corruptProb
+// applySchemaTag adds the constraints of a jsonschema struct tag to schema.
+// The tag is a comma-separated list of minimum=, maximum= and enum= entries,
+// with one enum entry per allowed value, and of zero for numbers that may also
+// be 0 to keep their default. On arrays and maps the constraints apply to the
+// elements.
+func applySchemaTag(schema map[string]any, tag string) {
+	if tag == "" {
+		return
+	}
 
-	if totalErrorProb <= 0 {
-		return 0
+	target := schema
+	if items, ok := schema["items"].(map[string]any); ok {
+		target = items
+	} else if values, ok := schema["additionalProperties"].(map[string]any); ok {
+		target = values
 	}
 
-	if totalErrorProb >= 1.0 {
-		return 1
+	bounds := target
+	if schemaAllowsZero(tag) {
+		bounds = map[string]any{}
 	}
 
-	maxSuccessive := int(5.0 / totalErrorProb)
-	if maxSuccessive < 5 {
-		return 5
+	minimum, maximum := schemaBounds(tag)
+	if minimum != nil {
+		bounds["minimum"] = *minimum
+	}
+	if maximum != nil {
+		bounds["maximum"] = *maximum
 	}
 
-	if maxSuccessive > 20 {
-		return 20
+	if schemaAllowsZero(tag) {
+		target["anyOf"] = []any{map[string]any{"const": 0}, bounds}
 	}
 
-	return maxSuccessive
+	for _, constraint := range strings.Split(tag, ",") {
+		if value, ok := strings.CutPrefix(constraint, "enum="); ok {
+			enum, _ := target["enum"].([]any)
+			target["enum"] = append(enum, value)
+		}
+	}
 }
 
-func selectForcedErrorType(disconnectProb, error500Prob, error400Prob, noBackendProb, corruptProb float64) string {
-	totalProb := disconnectProb + error500Prob + error400Prob + noBackendProb + corruptProb
-	if totalProb <= 0 {
-		return ""
+// schemaBounds returns the minimum and maximum of a jsonschema struct tag, nil
+// when the tag does not set them.
+func schemaBounds(tag string) (*float64, *float64) {
+	var minimum, maximum *float64
+	for _, constraint := range strings.Split(tag, ",") {
+		key, value, _ := strings.Cut(constraint, "=")
+		bound, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			continue
+		}
+
+		switch key {
+		case "minimum":
+			minimum = &bound
+		case "maximum":
+			maximum = &bound
+		}
 	}
 
-	errorTypes := []string{"disconnect", "error500", "error400", "no_backend", "corrupt"}
-	probabilities := []float64{disconnectProb, error500Prob, error400Prob, noBackendProb, corruptProb}
+	return minimum, maximum
+}
 
-	randomVal := rand.Float64() * totalProb
-	cumulativeProb := 0.0
+// schemaAllowsZero reports whether a jsonschema struct tag accepts 0 besides
+// its bounds.
+func schemaAllowsZero(tag string) bool {
+	return slices.Contains(strings.Split(tag, ","), "zero")
+}
 
-	for i, prob := range probabilities {
-		if prob <= 0 {
+// rangeViolations checks the numeric fields of the struct v, and the values of
+// its maps, pointers and slices of structs, against the bounds of their
+// jsonschema tags. It returns a description of every value out of range,
+// naming fields by their json path below prefix.
+func rangeViolations(v reflect.Value, prefix string) []string {
+	var violations []string
+	for i := range v.NumField() {
+		field := v.Type().Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			violations = append(violations, rangeViolations(v.Field(i), prefix)...)
 			continue
 		}
 
-		cumulativeProb += prob
-		if randomVal < cumulativeProb {
-			return errorTypes[i]
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if !field.IsExported() || name == "" || name == "-" {
+			continue
 		}
-	}
+		name = prefix + name
 
-	for i := len(probabilities) - 1; i >= 0; i-- {
-		if probabilities[i] > 0 {
-			return errorTypes[i]
+		value := v.Field(i)
+		switch value.Kind() {
+		case reflect.Slice:
+			if field.Type.Elem().Kind() == reflect.Struct {
+				for j := range value.Len() {
+					violations = append(violations, rangeViolations(value.Index(j), fmt.Sprintf("%s[%d].", name, j))...)
+				}
+			}
+		case reflect.Map:
+			minimum, maximum := schemaBounds(field.Tag.Get("jsonschema"))
+			var entries []string
+			for _, key := range value.MapKeys() {
+				entry := fmt.Sprintf("%s[%v]", name, key.Interface())
+				if field.Type.Elem().Kind() == reflect.Struct {
+					entries = append(entries, rangeViolations(value.MapIndex(key), entry+".")...)
+					continue
+				}
+				if msg := boundViolation(entry, value.MapIndex(key), minimum, maximum); msg != "" {
+					entries = append(entries, msg)
+				}
+			}
+			slices.Sort(entries)
+			violations = append(violations, entries...)
+		default:
+			tag := field.Tag.Get("jsonschema")
+			if value.IsZero() && schemaAllowsZero(tag) {
+				continue
+			}
+			minimum, maximum := schemaBounds(tag)
+			if msg := boundViolation(name, value, minimum, maximum); msg != "" {
+				violations = append(violations, msg)
+			}
 		}
 	}
 
-	return ""
+	return violations
 }
 
-func getEnv(key, fallback string) string {
-	value := os.Getenv(key)
-	if len(value) == 0 {
-		return fallback
+// boundViolation describes why the number v named name is outside
+// [minimum, maximum], or returns "" when it is inside or not a number. A nil
+// pointer is always inside.
+func boundViolation(name string, v reflect.Value, minimum, maximum *float64) string {
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return ""
+		}
+		v = v.Elem()
 	}
 
-	return value
+	var number float64
+	switch {
+	case v.CanInt():
+		number = float64(v.Int())
+	case v.CanFloat():
+		number = v.Float()
+	default:
+		return ""
+	}
+
+	if (minimum == nil || number >= *minimum) && (maximum == nil || number <= *maximum) {
+		return ""
+	}
+
+	switch {
+	case minimum != nil && maximum != nil:
+		return fmt.Sprintf("%s must be between %g and %g, got %g", name, *minimum, *maximum, number)
+	case minimum != nil && *minimum == 0:
+		return fmt.Sprintf("%s must not be negative, got %g", name, number)
+	case minimum != nil:
+		return fmt.Sprintf("%s must be at least %g, got %g", name, *minimum, number)
+	default:
+		return fmt.Sprintf("%s must be at most %g, got %g", name, *maximum, number)
+	}
 }
@@ -0,0 +1,681 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// startProxy serves proxyRequest in front of an httptest server running
+// backend, with cfg as the live configuration and fresh statistics, and
+// returns the URL of the proxy. The globals it replaces are restored when the
+// test ends, so tests using it must not run in parallel.
+func startProxy(t testing.TB, backend http.Handler, cfg ProxyConfig) string {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	if err := prepareConfig(&cfg); err != nil {
+		t.Fatalf("prepareConfig: %v", err)
+	}
+
+	upstream := httptest.NewServer(backend)
+	t.Cleanup(upstream.Close)
+
+	configMutex.RLock()
+	oldConfig := config
+	configMutex.RUnlock()
+	oldBackends, oldClient := backends, proxyClient
+
+	backends = []string{upstream.URL}
+	proxyClient = &http.Client{Transport: http.DefaultTransport.(*http.Transport).Clone()}
+	applyConfig(cfg, zap.NewNop(), "test")
+
+	clearStats(cfg.WindowSize, cfg.windowDuration())
+	resetRateLimits()
+	resetCircuit()
+
+	r := gin.New()
+	r.Any("/*path", func(c *gin.Context) {
+		proxyRequest(c, zap.NewNop(), zap.NewNop())
+	})
+	proxy := httptest.NewServer(r)
+
+	t.Cleanup(func() {
+		proxy.Close()
+		backends, proxyClient = oldBackends, oldClient
+		applyConfig(oldConfig, zap.NewNop(), "test")
+	})
+
+	return proxy.URL
+}
+
+// currentStats returns a copy of the global statistics.
+func currentStats() ErrorStats {
+	return statsReport()
+}
+
+// okBackend answers every request with a 200 and a short body.
+var okBackend = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	_, _ = io.WriteString(w, `{"status":"ok","message":"hello from the backend"}`)
+})
+
+// TestConcurrentRequestsCountStats sends requests through the proxy from
+// many goroutines. Run with -race, it fails if the counters or the request
+// number are updated without synchronization.
+func TestConcurrentRequestsCountStats(t *testing.T) {
+	proxyURL := startProxy(t, okBackend, ProxyConfig{
+		FaultConfig: FaultConfig{Error500: 0.2, Corrupt: 0.2, HeaderCorrupt: 0.1},
+	})
+
+	const workers, perWorker = 20, 10
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range perWorker {
+				resp, err := http.Get(proxyURL + "/hammer")
+				if err != nil {
+					t.Errorf("GET /hammer: %v", err)
+					return
+				}
+				_, _ = io.Copy(io.Discard, resp.Body)
+				_ = resp.Body.Close()
+			}
+		}()
+	}
+	wg.Wait()
+
+	got := currentStats()
+	if got.Total != workers*perWorker {
+		t.Errorf("total_requests = %d, want %d", got.Total, workers*perWorker)
+	}
+
+	pathTotal := int(pathCountersFor("/hammer").total.Load())
+	if pathTotal != workers*perWorker {
+		t.Errorf("path total_requests = %d, want %d", pathTotal, workers*perWorker)
+	}
+}
+
+// TestConcurrentForcedErrorsFireOnce checks that concurrent requests never
+// share a success streak: with an error forced after every four successes
+// and an error weight too small to be drawn, every fifth request fails.
+func TestConcurrentForcedErrorsFireOnce(t *testing.T) {
+	proxyURL := startProxy(t, okBackend, ProxyConfig{
+		FaultConfig:        FaultConfig{Error500: 1e-9},
+		WindowSize:         100,
+		ForceErrors:        true,
+		ForceMinSuccessive: 4,
+		ForceMaxSuccessive: 4,
+	})
+
+	const workers, perWorker = 20, 10
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range perWorker {
+				resp, err := http.Get(proxyURL + "/forced")
+				if err != nil {
+					t.Errorf("GET /forced: %v", err)
+					return
+				}
+				_, _ = io.Copy(io.Discard, resp.Body)
+				_ = resp.Body.Close()
+			}
+		}()
+	}
+	wg.Wait()
+
+	got := currentStats()
+	if want := workers * perWorker / 5; got.Error500Count != want {
+		t.Errorf("error_500_count = %d, want %d", got.Error500Count, want)
+	}
+}
+
+// shortBackend announces a longer body than it sends and closes the
+// connection.
+var shortBackend = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	conn, buf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		panic(err)
+	}
+	defer conn.Close()
+
+	_, _ = buf.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\nshort")
+	_ = buf.Flush()
+})
+
+// TestTruncatedBackendBodyIsBadGateway checks that the faults reading the
+// whole body answer a 502 instead of a 200 with a short body when the
+// backend closes early.
+func TestTruncatedBackendBodyIsBadGateway(t *testing.T) {
+	for name, faults := range map[string]FaultConfig{
+		"corrupt":      {Corrupt: 1},
+		"partial_hang": {PartialHang: 1},
+	} {
+		t.Run(name, func(t *testing.T) {
+			proxyURL := startProxy(t, shortBackend, ProxyConfig{FaultConfig: faults})
+
+			resp, err := http.Get(proxyURL + "/short")
+			if err != nil {
+				t.Fatalf("GET /short: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusBadGateway {
+				t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusBadGateway)
+			}
+			if _, err := io.ReadAll(resp.Body); err != nil {
+				t.Errorf("reading the 502: %v", err)
+			}
+		})
+	}
+}
+
+// TestBackendTrailersAreAnnounced checks that trailers of the backend are
+// announced in the response headers and reach the client after the body.
+func TestBackendTrailersAreAnnounced(t *testing.T) {
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum, X-Row-Count")
+		_, _ = io.WriteString(w, "rows")
+		w.Header().Set("X-Checksum", "abc123")
+		w.Header().Set("X-Row-Count", "4")
+	})
+	proxyURL := startProxy(t, backend, ProxyConfig{})
+
+	resp, err := http.Get(proxyURL + "/rows")
+	if err != nil {
+		t.Fatalf("GET /rows: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// the client moves the announced names from the Trailer header into
+	// resp.Trailer, with nil values until the body is read
+	announced := slices.Sorted(maps.Keys(resp.Trailer))
+	if want := []string{"X-Checksum", "X-Row-Count"}; !slices.Equal(announced, want) {
+		t.Errorf("announced trailers = %v, want %v", announced, want)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading body: %v", err)
+	}
+	if string(body) != "rows" {
+		t.Errorf("body = %q, want %q", body, "rows")
+	}
+	if got := resp.Trailer.Get("X-Checksum"); got != "abc123" {
+		t.Errorf("X-Checksum trailer = %q, want %q", got, "abc123")
+	}
+	if got := resp.Trailer.Get("X-Row-Count"); got != "4" {
+		t.Errorf("X-Row-Count trailer = %q, want %q", got, "4")
+	}
+}
+
+// TestEscapedPathReachesBackend checks that escaped characters of the path
+// and the query, such as an encoded slash, are forwarded unchanged.
+func TestEscapedPathReachesBackend(t *testing.T) {
+	received := make(chan *url.URL, 1)
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.URL
+	})
+	proxyURL := startProxy(t, backend, ProxyConfig{})
+
+	for _, tc := range []struct {
+		path, query string
+	}{
+		{"/files/a%2Fb", ""},
+		{"/files/a%2Fb/c%20d", "name=x%26y&tag=%2F"},
+		{"/plain/path", "q=1"},
+	} {
+		target := proxyURL + tc.path
+		if tc.query != "" {
+			target += "?" + tc.query
+		}
+
+		resp, err := http.Get(target)
+		if err != nil {
+			t.Fatalf("GET %s: %v", tc.path, err)
+		}
+		_ = resp.Body.Close()
+
+		got := <-received
+		if got.EscapedPath() != tc.path {
+			t.Errorf("backend path = %q, want %q", got.EscapedPath(), tc.path)
+		}
+		if got.RawQuery != tc.query {
+			t.Errorf("backend query = %q, want %q", got.RawQuery, tc.query)
+		}
+	}
+}
+
+// TestClientDisconnectCancelsBackend checks that the backend request is
+// cancelled when the client goes away, and that this is not counted as a
+// failure of the backend.
+func TestClientDisconnectCancelsBackend(t *testing.T) {
+	started, cancelled := make(chan struct{}), make(chan struct{})
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		select {
+		case <-r.Context().Done():
+			close(cancelled)
+		case <-time.After(5 * time.Second):
+		}
+	})
+	proxyURL := startProxy(t, backend, ProxyConfig{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, proxyURL+"/slow", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		errs <- err
+	}()
+
+	<-started
+	cancel()
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Errorf("client error = %v, want context.Canceled", err)
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("backend request was not cancelled")
+	}
+
+	// the proxy records backend failures after the backend call returns
+	deadline := time.Now().Add(2 * time.Second)
+	for inFlight.Load() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	got := currentStats()
+	if got.BackendErrorCount != 0 || got.BackendUnreachableCount != 0 || got.BackendTimeoutCount != 0 {
+		t.Errorf("backend failures = %d errors, %d unreachable, %d timeouts, want none",
+			got.BackendErrorCount, got.BackendUnreachableCount, got.BackendTimeoutCount)
+	}
+}
+
+// TestProbabilitiesAboveOneAreNormalized checks that with five probabilities
+// of 0.3, which sum to 1.5, every request gets one of the five errors in
+// equal shares.
+func TestProbabilitiesAboveOneAreNormalized(t *testing.T) {
+	faults := FaultConfig{Error500: 0.3, Error400: 0.3, Disconnect: 0.3, Corrupt: 0.3, NoBackend: 0.3}
+	weights := faults.faultWeights()
+	r := rand.New(rand.NewPCG(1, 2))
+
+	const requests = 10000
+	counts := map[string]int{}
+	for range requests {
+		counts[decideErrorType(r, 0, weights, forcePolicy{})]++
+	}
+
+	if counts[""] != 0 {
+		t.Errorf("%d requests passed through, want none", counts[""])
+	}
+	for _, w := range weights {
+		if w.prob == 0 {
+			continue
+		}
+		// a fifth of the requests each, within two percentage points
+		if share := float64(counts[w.errorType]) / requests; math.Abs(share-0.2) > 0.02 {
+			t.Errorf("%s got %.3f of the requests, want 0.2", w.errorType, share)
+		}
+		delete(counts, w.errorType)
+	}
+	delete(counts, "")
+	if len(counts) > 0 {
+		t.Errorf("unexpected error types %v", counts)
+	}
+}
+
+// TestBackoffHeadersOnlyOnInjectedErrors checks that Retry-After and the
+// X-RateLimit headers are added to injected 503 and 429 errors only.
+func TestBackoffHeadersOnlyOnInjectedErrors(t *testing.T) {
+	backoff := FaultConfig{RetryAfter: 7, RateLimitHeaders: true, RateLimitLimit: 50}
+	unavailableBackend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	for _, tc := range []struct {
+		name     string
+		backend  http.Handler
+		errors   map[int]float64
+		error500 float64
+		status   int
+		backoff  bool
+	}{
+		{"injected 503", okBackend, map[int]float64{503: 1}, 0, http.StatusServiceUnavailable, true},
+		{"injected 429", okBackend, map[int]float64{429: 1}, 0, http.StatusTooManyRequests, true},
+		{"injected 500", okBackend, nil, 1, http.StatusInternalServerError, false},
+		{"proxied 200", okBackend, nil, 0, http.StatusOK, false},
+		{"proxied 503", unavailableBackend, nil, 0, http.StatusServiceUnavailable, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			faults := backoff
+			faults.StatusErrors, faults.Error500 = tc.errors, tc.error500
+			proxyURL := startProxy(t, tc.backend, ProxyConfig{FaultConfig: faults})
+
+			resp, err := http.Get(proxyURL + "/backoff")
+			if err != nil {
+				t.Fatalf("GET /backoff: %v", err)
+			}
+			_ = resp.Body.Close()
+
+			if resp.StatusCode != tc.status {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tc.status)
+			}
+
+			want := map[string]string{
+				"Retry-After":           "",
+				"X-RateLimit-Limit":     "",
+				"X-RateLimit-Remaining": "",
+				"X-RateLimit-Reset":     "",
+			}
+			if tc.backoff {
+				want = map[string]string{
+					"Retry-After":           "7",
+					"X-RateLimit-Limit":     "50",
+					"X-RateLimit-Remaining": "0",
+					"X-RateLimit-Reset":     "7",
+				}
+			}
+			for name, value := range want {
+				if got := resp.Header.Get(name); got != value {
+					t.Errorf("%s = %q, want %q", name, got, value)
+				}
+			}
+		})
+	}
+}
+
+// TestHopByHopHeadersAreNotForwarded checks that Connection, the headers it
+// names and the standard hop-by-hop headers are dropped in both directions.
+func TestHopByHopHeadersAreNotForwarded(t *testing.T) {
+	received := make(chan http.Header, 1)
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Clone()
+		w.Header().Set("Connection", "X-Backend-Hop")
+		w.Header().Set("X-Backend-Hop", "hidden")
+		w.Header().Set("X-Backend-End", "kept")
+	})
+	proxyURL := startProxy(t, backend, ProxyConfig{})
+
+	req, err := http.NewRequest(http.MethodGet, proxyURL+"/hop", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Connection", "X-Client-Hop")
+	req.Header.Set("X-Client-Hop", "hidden")
+	req.Header.Set("Keep-Alive", "timeout=5")
+	req.Header.Set("Proxy-Authorization", "Basic c2VjcmV0")
+	req.Header.Set("X-Client-End", "kept")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /hop: %v", err)
+	}
+	_ = resp.Body.Close()
+
+	upstream := <-received
+	for _, name := range []string{"Connection", "X-Client-Hop", "Keep-Alive", "Proxy-Authorization"} {
+		if got := upstream.Get(name); got != "" {
+			t.Errorf("backend got %s: %q, want it dropped", name, got)
+		}
+	}
+	if got := upstream.Get("X-Client-End"); got != "kept" {
+		t.Errorf("backend got X-Client-End: %q, want %q", got, "kept")
+	}
+
+	if got := resp.Header.Get("X-Backend-Hop"); got != "" {
+		t.Errorf("client got X-Backend-Hop: %q, want it dropped", got)
+	}
+	if got := resp.Header.Get("X-Backend-End"); got != "kept" {
+		t.Errorf("client got X-Backend-End: %q, want %q", got, "kept")
+	}
+}
+
+// TestRangeViolationsAtBounds checks every field with jsonschema bounds just
+// inside and just outside of them: min-1 and max+1 are reported, min and max
+// are accepted.
+func TestRangeViolationsAtBounds(t *testing.T) {
+	for _, field := range reflect.VisibleFields(reflect.TypeFor[ProxyConfig]()) {
+		tag := field.Tag.Get("jsonschema")
+		minimum, maximum := schemaBounds(tag)
+		if field.Anonymous || (minimum == nil && maximum == nil) {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+
+		type bound struct {
+			value float64
+			valid bool
+		}
+		var bounds []bound
+		if minimum != nil {
+			bounds = append(bounds, bound{*minimum - 1, false}, bound{*minimum, true})
+		}
+		if maximum != nil {
+			bounds = append(bounds, bound{*maximum, true}, bound{*maximum + 1, false})
+		}
+		if schemaAllowsZero(tag) {
+			bounds = append(bounds, bound{0, true})
+		}
+
+		for _, b := range bounds {
+			t.Run(fmt.Sprintf("%s=%g", name, b.value), func(t *testing.T) {
+				var cfg ProxyConfig
+				setNumber(reflect.ValueOf(&cfg).Elem().FieldByIndex(field.Index), b.value)
+
+				violations := rangeViolations(reflect.ValueOf(cfg), "")
+				switch {
+				case b.valid && len(violations) > 0:
+					t.Errorf("got violations %q, want none", violations)
+				case !b.valid && len(violations) != 1:
+					t.Errorf("got violations %q, want one", violations)
+				case !b.valid && !strings.HasPrefix(violations[0], name):
+					t.Errorf("violation %q does not name %s", violations[0], name)
+				case !b.valid:
+					// POST /config answers a 400 with this error
+					if err := prepareConfig(&cfg); err == nil || !strings.Contains(err.Error(), violations[0]) {
+						t.Errorf("prepareConfig error = %v, want it to report %q", err, violations[0])
+					}
+				}
+			})
+		}
+	}
+}
+
+// setNumber stores n in v, a number, a pointer to a number or a map of
+// numbers, which gets n as its only value.
+func setNumber(v reflect.Value, n float64) {
+	switch v.Kind() {
+	case reflect.Pointer:
+		v.Set(reflect.New(v.Type().Elem()))
+		setNumber(v.Elem(), n)
+	case reflect.Map:
+		key := reflect.New(v.Type().Key()).Elem()
+		if key.CanInt() {
+			key.SetInt(503)
+		} else {
+			key.SetString("key")
+		}
+		value := reflect.New(v.Type().Elem()).Elem()
+		setNumber(value, n)
+		v.Set(reflect.MakeMap(v.Type()))
+		v.SetMapIndex(key, value)
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(n)
+	default:
+		v.SetInt(int64(n))
+	}
+}
+
+// TestConnectLatencyAddsToResponseLatency checks that the connect latency and
+// the response latency, or the error latency of injected errors, add up.
+func TestConnectLatencyAddsToResponseLatency(t *testing.T) {
+	errorLatency := 30
+	for _, tc := range []struct {
+		name   string
+		faults FaultConfig
+		want   time.Duration
+	}{
+		{"proxied", FaultConfig{ConnectLatencyMs: 60, LatencyMs: 90}, 150 * time.Millisecond},
+		{"injected error", FaultConfig{ConnectLatencyMs: 60, LatencyMs: 90, ErrorLatencyMs: &errorLatency, Error500: 1}, 90 * time.Millisecond},
+		{"connect only", FaultConfig{ConnectLatencyMs: 60}, 60 * time.Millisecond},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			proxyURL := startProxy(t, okBackend, ProxyConfig{FaultConfig: tc.faults})
+
+			start := time.Now()
+			resp, err := http.Get(proxyURL + "/delay")
+			if err != nil {
+				t.Fatalf("GET /delay: %v", err)
+			}
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+			elapsed := time.Since(start)
+
+			// the delays are sleeps, so the request never ends before their
+			// sum; how much longer it takes depends on the machine, and the
+			// upper bound only catches a delay applied far too often
+			if elapsed < tc.want {
+				t.Errorf("request took %v, want at least %v", elapsed, tc.want)
+			}
+			if limit := tc.want + 2*time.Second; elapsed > limit {
+				t.Errorf("request took %v, want less than %v", elapsed, limit)
+			}
+		})
+	}
+}
+
+// TestMatchQuery covers the query selector with empty queries, missing keys
+// and parameters present with an empty value.
+func TestMatchQuery(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		rawQuery string
+		match    map[string]string
+		want     bool
+	}{
+		{"no selector", "", nil, true},
+		{"no selector with query", "debug=true", nil, true},
+		{"empty query", "", map[string]string{"debug": "true"}, false},
+		{"missing key", "trace=1", map[string]string{"debug": "true"}, false},
+		{"matching value", "debug=true", map[string]string{"debug": "true"}, true},
+		{"other value", "debug=false", map[string]string{"debug": "true"}, false},
+		{"one of several values", "debug=false&debug=true", map[string]string{"debug": "true"}, true},
+		{"present but empty value", "debug=", map[string]string{"debug": ""}, true},
+		{"present without value", "debug", map[string]string{"debug": ""}, true},
+		{"empty value wanted but set", "debug=true", map[string]string{"debug": ""}, false},
+		{"empty value wanted but missing", "", map[string]string{"debug": ""}, false},
+		{"present but empty, value wanted", "debug=", map[string]string{"debug": "true"}, false},
+		{"escaped value", "tag=a%20b", map[string]string{"tag": "a b"}, true},
+		{"every key must match", "debug=true", map[string]string{"debug": "true", "tenant": "acme"}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := matchQuery(tc.rawQuery, tc.match); got != tc.want {
+				t.Errorf("matchQuery(%q, %v) = %v, want %v", tc.rawQuery, tc.match, got, tc.want)
+			}
+		})
+	}
+}
+
+// BenchmarkProxyRequestParallel measures the throughput of concurrent
+// requests through the proxy, which share the counters and the recent window.
+// The large window makes work done per request over the window show up.
+func BenchmarkProxyRequestParallel(b *testing.B) {
+	proxyURL := startProxy(b, okBackend, ProxyConfig{
+		FaultConfig: FaultConfig{Error500: 0.01, HeaderCorrupt: 0.01},
+		WindowSize:  1000,
+		ForceErrors: true,
+	})
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = 1000
+	client := &http.Client{Transport: transport}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			resp, err := client.Get(proxyURL + "/bench")
+			if err != nil {
+				b.Errorf("GET /bench: %v", err)
+				return
+			}
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+		}
+	})
+}
+
+// TestReencodeBodyNeverKeepsTheLabel checks that every mode leaves the body
+// mismatched with its Content-Encoding, also for bodies that cannot be
+// decoded.
+func TestReencodeBodyNeverKeepsTheLabel(t *testing.T) {
+	plain := []byte("hello from the backend")
+	for _, tc := range []struct {
+		name, encoding string
+		body           []byte
+	}{
+		{"plain", "", plain},
+		{"gzip", "gzip", gzipBytes(plain)},
+		{"broken gzip", "gzip", []byte("not gzip")},
+		{"br", "br", []byte("brotli bytes")},
+	} {
+		for _, mode := range badEncodingModes {
+			t.Run(tc.name+"/"+mode, func(t *testing.T) {
+				body, encoding, _ := reencodeBody(tc.body, tc.encoding, []string{mode})
+				if encoding == tc.encoding && bytes.Equal(body, tc.body) {
+					t.Errorf("body still matches Content-Encoding %q", encoding)
+				}
+				if len(body) == 0 {
+					t.Error("body is empty")
+				}
+			})
+		}
+	}
+}
+
+// TestBackendsReadyWithoutHealthEntry checks that a backend missing from the
+// health table counts as not checked instead of panicking.
+func TestBackendsReadyWithoutHealthEntry(t *testing.T) {
+	oldBackends, oldPath := backends, healthCheckPath
+	t.Cleanup(func() { backends, healthCheckPath = oldBackends, oldPath })
+	backends = []string{"http://unseeded.invalid"}
+
+	healthCheckPath = ""
+	if !backendsReady() {
+		t.Error("backendsReady() = false without health checks, want true")
+	}
+
+	healthCheckPath = "/healthz"
+	if backendsReady() {
+		t.Error("backendsReady() = true before the first health check, want false")
+	}
+}